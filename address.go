@@ -0,0 +1,262 @@
+package mbox_reader
+
+import (
+	"strings"
+)
+
+// Address is a mailbox from an address header such as From or To. Group is
+// the name of the group the mailbox is listed in, if any.
+type Address struct {
+	Name      string
+	LocalPart string
+	Domain    string
+	Group     string
+}
+
+// Address returns the addr-spec, local-part@domain.
+func (address Address) Address() string {
+	if address.Domain == "" {
+		return address.LocalPart
+	}
+	return address.LocalPart + "@" + address.Domain
+}
+
+// String returns the address as it would be written in a header.
+func (address Address) String() string {
+	if address.Name == "" {
+		return "<" + address.Address() + ">"
+	}
+	return "\"" + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(address.Name) + "\" <" + address.Address() + ">"
+}
+
+// From returns the addresses of the From header.
+func (message Message) From() []Address {
+	return message.Addresses(H_FROM)
+}
+
+// To returns the addresses of the To headers.
+func (message Message) To() []Address {
+	return message.Addresses(H_TO)
+}
+
+// Cc returns the addresses of the Cc headers.
+func (message Message) Cc() []Address {
+	return message.Addresses(H_CC)
+}
+
+// Bcc returns the addresses of the Bcc headers, which only sent messages keep.
+func (message Message) Bcc() []Address {
+	return message.Addresses(H_BCC)
+}
+
+// ReplyTo returns the addresses of the Reply-To header.
+func (message Message) ReplyTo() []Address {
+	return message.Addresses(H_REPLY_TO)
+}
+
+// Addresses parses all values of the header with the given case-insensitive
+// name as address lists. Malformed entries are kept as far as they can be
+// understood rather than rejected. The raw values are parsed and only display
+// names are decoded afterwards, so encoded words can not pose as addresses.
+func (message Message) Addresses(name string) []Address {
+	addresses := make([]Address, 0)
+	for _, field := range message.HeaderFieldsByName(name) {
+		addresses = append(addresses, parseAddressList(field.Value())...)
+	}
+	return addresses
+}
+
+// parseAddressList parses an RFC 5322 address list with groups, quoted
+// display names, comments and obsolete forms such as "addr (Name)".
+// Unquoted display names containing commas, like "Doe, John <j@doe.com>",
+// are put back together.
+func parseAddressList(value string) []Address {
+	addresses := make([]Address, 0)
+	var group string
+	var pending string
+	for _, item := range splitAddressList(value) {
+		text := strings.Trim(item.text, " \t\r\n")
+		if item.groupStart {
+			group = decodeDisplayName(text)
+			pending = ""
+			continue
+		}
+		if text != "" {
+			if pending != "" && indexUnquoted(stripAddressComments(text), '<') > 0 {
+				text = pending + ", " + text
+			} else if pending != "" {
+				addresses = append(addresses, Address{LocalPart: pending, Group: group})
+			}
+			pending = ""
+			if !strings.ContainsAny(stripAddressComments(text), "@<") {
+				// a display name split at an unquoted comma, or a bare local part
+				pending = text
+			} else {
+				address := parseAddress(text)
+				address.Group = group
+				addresses = append(addresses, address)
+			}
+		}
+		if item.groupEnd {
+			if pending != "" {
+				addresses = append(addresses, Address{LocalPart: pending, Group: group})
+				pending = ""
+			}
+			group = ""
+		}
+	}
+	if pending != "" {
+		addresses = append(addresses, Address{LocalPart: pending, Group: group})
+	}
+	return addresses
+}
+
+type addressListItem struct {
+	text       string
+	groupStart bool
+	groupEnd   bool
+}
+
+// splitAddressList splits an address list at commas, group colons and group
+// semicolons that are not quoted, commented or inside angle brackets.
+func splitAddressList(value string) []addressListItem {
+	var items []addressListItem
+	var current []byte
+	var inQuotes, inAngle bool
+	var commentDepth int
+	for idx := 0; idx < len(value); idx++ {
+		char := value[idx]
+		switch {
+		case char == '\\' && (inQuotes || commentDepth > 0) && idx+1 < len(value):
+			current = append(current, char, value[idx+1])
+			idx++
+			continue
+		case inQuotes:
+			inQuotes = char != '"'
+		case char == '"' && commentDepth == 0:
+			inQuotes = true
+		case char == '(':
+			commentDepth++
+		case char == ')' && commentDepth > 0:
+			commentDepth--
+		case commentDepth > 0:
+		case char == '<':
+			inAngle = true
+		case char == '>':
+			inAngle = false
+		case inAngle:
+		case char == ',':
+			items = append(items, addressListItem{text: string(current)})
+			current = current[:0]
+			continue
+		case char == ':':
+			items = append(items, addressListItem{text: string(current), groupStart: true})
+			current = current[:0]
+			continue
+		case char == ';':
+			items = append(items, addressListItem{text: string(current), groupEnd: true})
+			current = current[:0]
+			continue
+		}
+		current = append(current, char)
+	}
+	return append(items, addressListItem{text: string(current)})
+}
+
+// parseAddress parses a single "Name <addr>" or "addr (Name)" mailbox.
+func parseAddress(text string) Address {
+	var address Address
+	var addrSpec string
+	if angleIdx := indexUnquoted(text, '<'); angleIdx != -1 {
+		address.Name = decodeDisplayName(stripAddressComments(text[:angleIdx]))
+		addrSpec = text[angleIdx+1:]
+		if endIdx := strings.IndexByte(addrSpec, '>'); endIdx != -1 {
+			addrSpec = addrSpec[:endIdx]
+		}
+	} else {
+		addrSpec = stripAddressComments(text)
+		if start, end := strings.IndexByte(text, '('), strings.LastIndexByte(text, ')'); start != -1 && end > start {
+			address.Name = decodeDisplayName(text[start+1 : end])
+		}
+	}
+
+	// a source route such as "@relay.net:user@example.com" is obsolete
+	addrSpec = strings.Trim(addrSpec, " \t")
+	if strings.HasPrefix(addrSpec, "@") {
+		if colonIdx := strings.IndexByte(addrSpec, ':'); colonIdx != -1 {
+			addrSpec = addrSpec[colonIdx+1:]
+		}
+	}
+	if atIdx := strings.LastIndexByte(addrSpec, '@'); atIdx != -1 {
+		address.LocalPart = unquoteParamValue(strings.Trim(addrSpec[:atIdx], " \t"))
+		address.Domain = strings.Trim(addrSpec[atIdx+1:], " \t[]")
+	} else {
+		address.LocalPart = unquoteParamValue(addrSpec)
+	}
+	return address
+}
+
+// decodeDisplayName unquotes a display name and decodes its encoded words.
+func decodeDisplayName(name string) string {
+	name = strings.Trim(name, " \t\r\n")
+	if strings.HasPrefix(name, "\"") && strings.HasSuffix(name, "\"") && len(name) > 1 {
+		name = unquoteParamValue(name)
+	}
+	return strings.Trim(decodeMimeEncoded(name), " \t")
+}
+
+// stripAddressComments removes parenthesized comments outside quoted strings.
+func stripAddressComments(text string) string {
+	var stripped []byte
+	var inQuotes bool
+	var commentDepth int
+	for idx := 0; idx < len(text); idx++ {
+		char := text[idx]
+		switch {
+		case char == '\\' && idx+1 < len(text):
+			if commentDepth == 0 {
+				stripped = append(stripped, char, text[idx+1])
+			}
+			idx++
+			continue
+		case inQuotes:
+			inQuotes = char != '"'
+		case char == '"' && commentDepth == 0:
+			inQuotes = true
+		case char == '(':
+			commentDepth++
+			continue
+		case char == ')' && commentDepth > 0:
+			commentDepth--
+			continue
+		}
+		if commentDepth == 0 {
+			stripped = append(stripped, char)
+		}
+	}
+	return strings.Trim(string(stripped), " \t")
+}
+
+// indexUnquoted returns the index of the first char outside a quoted string.
+func indexUnquoted(text string, target byte) int {
+	inQuotes := false
+	for idx := 0; idx < len(text); idx++ {
+		switch {
+		case text[idx] == '\\' && inQuotes:
+			idx++
+		case text[idx] == '"':
+			inQuotes = !inQuotes
+		case text[idx] == target && !inQuotes:
+			return idx
+		}
+	}
+	return -1
+}
+
+// addressMatchesDomain reports whether the address is in domain or in one of
+// its subdomains.
+func addressMatchesDomain(address Address, domain string) bool {
+	addrDomain := strings.ToLower(address.Domain)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "@"))
+	return addrDomain == domain || strings.HasSuffix(addrDomain, "."+domain)
+}
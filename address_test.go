@@ -0,0 +1,50 @@
+package mbox_reader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseAddressList(t *testing.T) {
+	type AddressTestItem struct {
+		Name      string `json:"name"`
+		LocalPart string `json:"local-part"`
+		Domain    string `json:"domain"`
+		Group     string `json:"group"`
+	}
+	type ParseAddressListTestCase struct {
+		Value     string            `json:"value"`
+		Addresses []AddressTestItem `json:"addresses"`
+	}
+	testTable := make([]ParseAddressListTestCase, 0)
+	data, err := ioutil.ReadFile("testcases/parse_address_list_cases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			addresses := parseAddressList(tcase.Value)
+			if len(addresses) != len(tcase.Addresses) {
+				t.Fatalf("Addresses count is not correct. Want:%d, got:%d %+v\n", len(tcase.Addresses), len(addresses), addresses)
+			}
+			for aind, want := range tcase.Addresses {
+				got := AddressTestItem{
+					Name:      addresses[aind].Name,
+					LocalPart: addresses[aind].LocalPart,
+					Domain:    addresses[aind].Domain,
+					Group:     addresses[aind].Group,
+				}
+				if got != want {
+					t.Errorf("Address %d is not correct. Want:%+v, got:%+v\n", aind, want, got)
+				}
+			}
+		})
+	}
+}
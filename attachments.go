@@ -1,59 +1,144 @@
 package mbox_reader
 
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// AbstractAttachment holds what every attachment has: its MIME type and
+// where its content is stored in the mailbox. The content is only read when
+// asked for.
 type AbstractAttachment struct {
 	mimeType         string
 	transferEncoding string
-	content          string
+	source           io.ReaderAt
+	start            int64
+	length           int64
+	quoting          MboxFormat
 }
 
+// NamedAttachment is a file attached to a message.
 type NamedAttachment struct {
 	AbstractAttachment
 	filename string
 	name     string
 }
 
+// InlineAttachment is a part referenced by its Content-ID, usually an image
+// embedded into an HTML body.
 type InlineAttachment struct {
 	AbstractAttachment
 	contentId string
 }
 
+// AbstractAttachmentIface is implemented by every attachment.
 type AbstractAttachmentIface interface {
-	getContents(bool) string
-	getTransferEncoding() string
-	getMimeType() string
+	Contents(bool) (string, error)
+	ContentReader() io.Reader
+	EncodedReader() io.Reader
+	EncodedContents() ([]byte, error)
+	TransferEncoding() string
+	MimeType() string
 }
 
+var _ NamedAttachmentIface = NamedAttachment{}
+var _ InlineAttachmentIface = InlineAttachment{}
+
+// NamedAttachmentIface is implemented by attachments with a file name.
 type NamedAttachmentIface interface {
 	AbstractAttachmentIface
-	getFileName() string
-	getName() string
+	FileName() string
+	Name() string
 }
 
+// InlineAttachmentIface is implemented by attachments with a Content-ID.
 type InlineAttachmentIface interface {
 	AbstractAttachmentIface
-	getContentId() string
+	ContentId() string
+}
+
+// Contents returns the attachment content, decoded from its transfer
+// encoding when decoded is true and exactly as stored in the mailbox otherwise.
+func (attachment AbstractAttachment) Contents(decoded bool) (string, error) {
+	reader := attachment.EncodedReader()
+	if decoded {
+		reader = attachment.ContentReader()
+	}
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(contents), nil
+}
+
+// ContentReader returns a reader over the content decoded from base64,
+// quoted-printable or passed through as is for 7bit, 8bit and binary.
+// The content is read from the mailbox lazily.
+func (attachment AbstractAttachment) ContentReader() io.Reader {
+	return newTransferDecoder(attachment.EncodedReader(), attachment.transferEncoding)
 }
 
-func (attachment AbstractAttachment) getContents(decoded bool) string {
-	return ""
+// EncodedReader returns a reader over the content still in its transfer encoding.
+func (attachment AbstractAttachment) EncodedReader() io.Reader {
+	return newContentReader(attachment.source, attachment.start, attachment.length, attachment.quoting)
 }
 
-func (attachment AbstractAttachment) getTransferEncoding() string {
-	return ""
+// EncodedContents returns the content still in its transfer encoding.
+func (attachment AbstractAttachment) EncodedContents() ([]byte, error) {
+	return ioutil.ReadAll(attachment.EncodedReader())
 }
 
-func (attachment AbstractAttachment) getMimeType() string {
-	return ""
+// TransferEncoding returns the lower-cased Content-Transfer-Encoding, 7bit by default.
+func (attachment AbstractAttachment) TransferEncoding() string {
+	return attachment.transferEncoding
 }
 
-func (attachment NamedAttachment) getFileName() string {
-	return ""
+// MimeType returns the MIME type of the part as Part.ContentType does,
+// including its default when the Content-Type header is missing.
+func (attachment AbstractAttachment) MimeType() string {
+	return attachment.mimeType
 }
 
-func (attachment NamedAttachment) getName() string {
-	return ""
+// FileName returns the Content-Disposition filename, falling back to the
+// Content-Type name.
+func (attachment NamedAttachment) FileName() string {
+	return attachment.filename
 }
 
-func (attachment InlineAttachment) getContentId() string {
-	return ""
+// Name returns the Content-Type name parameter.
+func (attachment NamedAttachment) Name() string {
+	return attachment.name
+}
+
+// ContentId returns the Content-ID without the angle brackets.
+func (attachment InlineAttachment) ContentId() string {
+	return attachment.contentId
+}
+
+// newAttachment builds an attachment from a part of the message. Parts
+// with a Content-ID that are not explicitly disposed as attachments are
+// inline parts referenced from an HTML body, everything else is named.
+func newAttachment(part *Part) AbstractAttachmentIface {
+	abstract := AbstractAttachment{
+		mimeType:         part.contentType,
+		transferEncoding: part.transferEncoding(),
+		source:           part.source,
+		start:            part.base + part.start,
+		length:           part.end - part.start,
+		quoting:          part.quoting,
+	}
+
+	if contentId, ok := part.headers[string(H_CT_ID)]; ok && len(contentId) > 0 && part.disposition() != CD_ATTACHMENT {
+		return InlineAttachment{
+			AbstractAttachment: abstract,
+			contentId:          strings.Trim(contentId[0], " \t<>"),
+		}
+	}
+
+	return NamedAttachment{
+		AbstractAttachment: abstract,
+		filename:           part.getFileName(),
+		name:               part.Param("name"),
+	}
 }
@@ -1,12 +1,21 @@
 package mbox_reader
 
 const H_FROM = "FROM"
+const H_TO = "TO"
+const H_CC = "CC"
+const H_BCC = "BCC"
+const H_REPLY_TO = "REPLY-TO"
 const H_SUBJECT = "SUBJECT"
 const H_DATE = "DATE"
 const H_CT_TYPE = "CONTENT-TYPE"
 const H_TR_ENC = "CONTENT-TRANSFER-ENCODING"
 const H_CT_DISP = "CONTENT-DISPOSITION"
 const H_CT_ID = "CONTENT-ID"
+const H_CT_LENGTH = "CONTENT-LENGTH"
+const H_STATUS = "STATUS"
+const H_X_STATUS = "X-STATUS"
+const H_X_MOZ_STATUS = "X-MOZILLA-STATUS"
+const H_X_MOZ_STATUS2 = "X-MOZILLA-STATUS2"
 
 const TR_ENC_7BIT = "7bit"
 const TR_ENC_QPRNT = "quoted-printable"
@@ -14,13 +23,43 @@ const TR_ENC_B64 = "base64"
 const TR_ENC_8BIT = "8bit"
 const TR_ENC_BIN = "binary"
 
+const CT_MP_PREFIX = "multipart/"
 const CT_MP_MIXED = "multipart/mixed"
 const CT_MP_RELATED = "multipart/related"
 const CT_MP_ALTER = "multipart/alternative"
+const CT_MP_DIGEST = "multipart/digest"
+const CT_MSG_RFC822 = "message/rfc822"
 const CT_TXT_PLAIN = "text/plain"
 const CT_TXT_HTML = "text/html"
 
+// CT_DEFAULT is the Content-Type of a part that has none, as RFC 2045 says.
+const CT_DEFAULT = "text/plain; charset=us-ascii"
+
 const CD_ATTACHMENT = "attachment"
 const CD_INLINE = "inline"
 
 const HEAD_TIMESTAMP_FMT = "Mon Jan  2 15:04:05 2006"
+
+// MboxFormat tells how messages are delimited in a mailbox.
+type MboxFormat int
+
+const (
+	// MBOX_FMT_AUTO reads body lines as MBOX_FMT_MBOXO does, but trusts
+	// a Content-Length header when it ends exactly before the next From_
+	// line or at the end of the mailbox and then reads the body as
+	// MBOX_FMT_MBOXCL2 does.
+	MBOX_FMT_AUTO MboxFormat = iota
+	// MBOX_FMT_MBOXO delimits messages by From_ lines only. Body lines
+	// starting with ">From " lose their ">"; lines quoted more than once
+	// are kept as is, since mboxo can not tell them from original text.
+	MBOX_FMT_MBOXO
+	// MBOX_FMT_MBOXCL delimits messages by their Content-Length header,
+	// body lines starting with "From " are still quoted with ">".
+	MBOX_FMT_MBOXCL
+	// MBOX_FMT_MBOXCL2 delimits messages by their Content-Length header,
+	// body lines are not quoted.
+	MBOX_FMT_MBOXCL2
+	// MBOX_FMT_MBOXRD delimits messages by From_ lines only. One ">" is
+	// removed from every body line matching ^>+From .
+	MBOX_FMT_MBOXRD
+)
@@ -0,0 +1,195 @@
+package mbox_reader
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// TimeSource tells which timestamp of a message the time filters compare.
+type TimeSource int
+
+const (
+	// TIME_SRC_ENVELOPE uses the delivery time from the From_ line.
+	TIME_SRC_ENVELOPE TimeSource = iota
+	// TIME_SRC_DATE_HEADER uses the Date header. Messages without a valid
+	// Date header do not pass the time filters.
+	TIME_SRC_DATE_HEADER
+	// TIME_SRC_DATE_HEADER_OR_ENVELOPE uses the Date header and falls back
+	// to the From_ line when it is missing or invalid.
+	TIME_SRC_DATE_HEADER_OR_ENVELOPE
+)
+
+// fromLineDateLayouts are the From_ line timestamps seen in the wild, with
+// runs of spaces collapsed. The first one is HEAD_TIMESTAMP_FMT.
+var fromLineDateLayouts = []string{
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 2006 -0700",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"Mon Jan 2 15:04:05 MST -0700 2006",
+	"Mon Jan 2 15:04 2006",
+	"Mon Jan 2 15:04 -0700 2006",
+	"Mon Jan 2 2006 15:04:05",
+	"Mon Jan 2 2006 15:04:05 -0700",
+	"Jan 2 15:04:05 2006",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+}
+
+// dateHeaderLayouts are tried when net/mail can not parse a Date header.
+var dateHeaderLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 06 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"Mon, Jan 2 2006 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"Monday, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 January 2006 15:04:05 -0700",
+}
+
+// obsoleteZones are the zone names RFC 5322 section 4.3 gives offsets for.
+var obsoleteZones = map[string]string{
+	"UT":  "+0000",
+	"UTC": "+0000",
+	"GMT": "+0000",
+	"EST": "-0500",
+	"EDT": "-0400",
+	"CST": "-0600",
+	"CDT": "-0500",
+	"MST": "-0700",
+	"MDT": "-0600",
+	"PST": "-0800",
+	"PDT": "-0700",
+}
+
+// unknownZone is the location of times given in -0000, a zone RFC 5322 uses
+// for times in UTC whose local zone is not known.
+var unknownZone = time.FixedZone("-0000", 0)
+
+// replaceZoneNames replaces a zone name following the time of day, or the
+// year after it, with its offset. Other names, such as "MSK", mean different
+// offsets to different systems and are taken as -0000, as RFC 5322 advises;
+// time.Parse would give them the offset they have in the local zone, if any.
+// A name followed by an offset is left to the offset. It also returns the
+// index of the field giving -0000, or -1.
+func replaceZoneNames(fields []string) ([]string, int) {
+	replaced := make([]string, len(fields))
+	copy(replaced, fields)
+	unknown := -1
+	for ind := 1; ind < len(replaced); ind++ {
+		afterTime := strings.Contains(replaced[ind-1], ":") || ind > 1 && strings.Contains(replaced[ind-2], ":")
+		if !afterTime {
+			continue
+		}
+		if replaced[ind] == "-0000" {
+			unknown = ind
+		}
+		if !isZoneName(replaced[ind]) || ind+1 < len(replaced) && strings.IndexAny(replaced[ind+1][:1], "+-") == 0 {
+			continue
+		}
+		offset, ok := obsoleteZones[strings.ToUpper(replaced[ind])]
+		if !ok {
+			offset = "-0000"
+			unknown = ind
+		}
+		replaced[ind] = offset
+	}
+	return replaced, unknown
+}
+
+func isZoneName(field string) bool {
+	if len(field) == 0 || len(field) > 5 {
+		return false
+	}
+	for _, char := range field {
+		if (char < 'A' || char > 'Z') && (char < 'a' || char > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFromLineDate parses the timestamp of a From_ line. Anything after a
+// recognised timestamp, such as "remote from host", is ignored. Timestamps
+// without a zone are taken as UTC.
+func parseFromLineDate(value string) (time.Time, error) {
+	fields, unknown := replaceZoneNames(strings.Fields(value))
+	for count := len(fields); count >= 3; count-- {
+		if date, ok := parseWithLayouts(strings.Join(fields[:count], " "), fromLineDateLayouts); ok {
+			return inZone(date, unknown != -1 && unknown < count), nil
+		}
+	}
+	return parseDateHeader(value)
+}
+
+// parseDateHeader parses an RFC 5322 Date header with its zone, accepting
+// the obsolete and broken forms mailers commonly produce.
+func parseDateHeader(value string) (time.Time, error) {
+	fields, unknown := replaceZoneNames(strings.Fields(value))
+	value = strings.Join(fields, " ")
+	date, err := mail.ParseDate(value)
+	if err == nil {
+		return inZone(date, unknown != -1), nil
+	}
+	// comments like "(MSK)" and a trailing period
+	fields, unknown = replaceZoneNames(strings.Fields(strings.TrimRight(stripAddressComments(value), " .")))
+	cleaned := strings.Join(fields, " ")
+	if date, err = mail.ParseDate(cleaned); err == nil {
+		return inZone(date, unknown != -1), nil
+	}
+	for count := len(fields); count >= 3; count-- {
+		if date, ok := parseWithLayouts(strings.Join(fields[:count], " "), dateHeaderLayouts); ok {
+			return inZone(date, unknown != -1 && unknown < count), nil
+		}
+	}
+	return time.Time{}, ErrInvalidDate
+}
+
+// inZone puts a time given in -0000 into unknownZone.
+func inZone(date time.Time, unknown bool) time.Time {
+	if unknown {
+		return date.In(unknownZone)
+	}
+	return date
+}
+
+func parseWithLayouts(value string, layouts []string) (time.Time, bool) {
+	for _, layout := range layouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Date returns the time from the Date header, with its zone. A time in an
+// unknown zone, given as -0000 or with a zone name RFC 5322 does not define,
+// is in UTC with the zone named "-0000".
+func (message Message) Date() (time.Time, error) {
+	header, ok := message.Header(H_DATE)
+	if !ok || len(header.Values) == 0 {
+		return time.Time{}, ErrNoDateHeader
+	}
+	return parseDateHeader(header.Values[0])
+}
+
+// filterTime returns the timestamp the time filters compare, or false when
+// the message has none of the chosen kind.
+func (message Message) filterTime(source TimeSource) (time.Time, bool) {
+	if source == TIME_SRC_ENVELOPE {
+		return message.timestamp, true
+	}
+	date, err := message.Date()
+	if err == nil {
+		return date, true
+	}
+	if source == TIME_SRC_DATE_HEADER_OR_ENVELOPE {
+		return message.timestamp, !message.timestamp.IsZero()
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,73 @@
+// Package mbox_reader reads messages from mbox mailboxes.
+//
+// A reader is created either for a file with NewMboxReader or for any stream
+// with NewMboxReaderFromReader. Filters narrow down what Read returns:
+//
+//	mboxReader, err := mbox_reader.NewMboxReader("/var/mail/user", 3, 0)
+//	if err != nil {
+//		return err
+//	}
+//	mboxReader.WithHeader("Subject", "Invoice").WithAttachmentName("*.pdf")
+//	msg, err := mboxReader.Read()
+//
+// Header looks headers up by name with their values unfolded and decoded;
+// HeaderFields keeps them in their original order, spelling and folding.
+//
+// Address headers such as From and To are parsed into Address values by
+// the accessors of the same names, and WithAddress and WithAddressDomain
+// filter on them.
+//
+// The time filters compare the From_ line timestamp by default; SetTimeSource
+// switches them to the Date header, which Date parses with its zone.
+//
+// Every message exposes its envelope sender and timestamp, headers, bodies
+// by MIME type and attachments through the methods of MessageIface. The full
+// MIME tree of a message, with multiparts of any subtype nested to any depth,
+// is reached through Root and Walk. Text bodies are converted to UTF-8 from
+// the charset they declare or, when it is missing or wrong, the one detected
+// from their content; RawBody returns them unconverted. Messages embedded as
+// message/rfc822 parts, such as forwards and the originals in bounce reports,
+// are parsed as messages of their own and returned by EmbeddedMessages.
+//
+// A mailbox file is locked with a shared flock(2) lock for every Read.
+// SetLockStrategy switches to fcntl(2) locks, dot lock files, both, or no
+// locking, to match the mail delivery agent writing the mailbox. Waiting for
+// the lock is bounded by the lock trials settings and, with ReadContext, by a
+// context. Begin and End hold the lock across a whole scan instead, which
+// then sees the mailbox as it was when Begin was called.
+//
+// MboxWriter appends messages to a mailbox file under an exclusive lock,
+// writing the From_ line, quoting body lines for the chosen format and adding
+// Content-Length for mboxcl and mboxcl2. Expunge removes the messages passing
+// the reader filters by rewriting the mailbox to a temporary file and
+// renaming it into place; a dry run only reports them.
+//
+// Flags decodes the read, answered, flagged and deleted state mail clients
+// keep in the Status, X-Status and X-Mozilla-Status headers, WithFlags and
+// WithoutFlags filter on it, so WithoutFlags(FLAG_SEEN) reads unread messages
+// only, and SetFlags updates it in place as long as the headers have room.
+//
+// By default Read fails on the first message it can not parse. SetParseMode
+// with PARSE_MODE_LENIENT returns such messages parsed as far as possible,
+// listing the problems in Warnings, and PARSE_MODE_SKIP skips them; either
+// way reading goes on from the next From_ line and SkippedMessages reports
+// what was left out. Parse errors are *ParseError values locating the
+// message by its number, byte offset and line, and wrap the sentinel errors
+// of the package, such as ErrClosingBoundaryMissing, for errors.Is.
+//
+// Only the headers of a message are kept in memory. Bodies and attachments of
+// a mailbox file are read from the file when asked for, with BodyReader and
+// ContentReader doing so in constant memory, so message size does not matter.
+// A stream can not be read twice, so a message read from one is held in memory
+// as a whole until it is released.
+//
+// # Compatibility
+//
+// The package follows semantic versioning. Starting with v1.0.0 exported
+// identifiers are neither removed nor changed in an incompatible way within
+// a major version. MessageIface, MboxReaderIface and the attachment
+// interfaces describe the methods of the types of this package and may gain
+// new methods in minor versions, so they are meant to be used, not to be
+// implemented outside the package. Unexported identifiers and the text of
+// error messages are not covered; errors are matched with errors.Is instead.
+package mbox_reader
@@ -0,0 +1,100 @@
+package mbox_reader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors returned by the package. Parse errors come wrapped in a ParseError
+// and are matched with errors.Is.
+var (
+	ErrNotMessageStart        = errors.New("Not a message start line.")
+	ErrMalformedFromLine      = errors.New("A white space after message id is missing.")
+	ErrInvalidDate            = errors.New("The date can not be parsed")
+	ErrNoDateHeader           = errors.New("The message does not have a Date header")
+	ErrEmptyBoundary          = errors.New("The message is multipart but a boundary is empty")
+	ErrBoundaryMissing        = errors.New("The multipart boundary is missing")
+	ErrClosingBoundaryMissing = errors.New("The closing boundary is missing")
+	ErrLocked                 = errors.New("Couldn't lock the file")
+	ErrSessionActive          = errors.New("A read session is already in progress")
+	ErrInvalidSender          = errors.New("The envelope sender can not contain white space")
+	ErrNoFilters              = errors.New("No filters are set to select the messages")
+	ErrFlagsDoNotFit          = errors.New("The flags do not fit into the status headers of the message")
+	ErrMessageMoved           = errors.New("The message is not found at its offset in the mailbox")
+	ErrNotRewindable          = errors.New("The stream can not be rewound")
+	ErrNoMailboxFile          = errors.New("An index can only be used with a mailbox file")
+	ErrNoIndex                = errors.New("The reader has no index")
+	ErrIndexOutOfDate         = errors.New("The index is out of date")
+	ErrIndexFormat            = errors.New("The index was built for another mailbox format")
+	ErrIndexOutOfRange        = errors.New("The message number is out of the index range")
+)
+
+// ParseError is an error in a message of a mailbox together with where it
+// was found. Path is empty for a stream, Index is the zero-based number of
+// the message in the mailbox, Offset the byte offset of the problem and Line
+// its one-based line number, or 0 when the line is not known, as after
+// seeking with an index that does not record lines.
+type ParseError struct {
+	Path   string
+	Index  int
+	Offset int64
+	Line   int
+	Err    error
+}
+
+func (parseError *ParseError) Error() string {
+	location := fmt.Sprintf("message %d, offset %d", parseError.Index, parseError.Offset)
+	if parseError.Line > 0 {
+		location += fmt.Sprintf(", line %d", parseError.Line)
+	}
+	if parseError.Path != "" {
+		location = parseError.Path + ": " + location
+	}
+	return location + ": " + parseError.Err.Error()
+}
+
+func (parseError *ParseError) Unwrap() error {
+	return parseError.Err
+}
+
+// newParseError locates an error returned while parsing msg. Errors found by
+// the parser carry their offset in the message; others are put at its start.
+func (mboxReader *MboxReader) newParseError(msg *Message, err error) *ParseError {
+	var offset int64
+	var warning ParseWarning
+	if errors.As(err, &warning) {
+		offset = warning.Offset
+		err = warning.Err
+	}
+	return &ParseError{
+		Path:   mboxReader.filepath,
+		Index:  msg.number,
+		Offset: msg.offset + offset,
+		Line:   msg.lineAt(offset),
+		Err:    err,
+	}
+}
+
+// lineAt returns the line number of the given offset in the message, or 0
+// when the line of the message itself is not known.
+func (message *Message) lineAt(offset int64) int {
+	if message.line == 0 || message.source == nil {
+		return message.line
+	}
+	offset = min(offset, message.length)
+	line := message.line
+	buffer := make([]byte, readerBufferSize)
+	section := io.NewSectionReader(message.source, message.base, offset)
+	for {
+		read, err := section.Read(buffer)
+		for _, char := range buffer[:read] {
+			if char == '\n' {
+				line++
+			}
+		}
+		if err != nil {
+			return line
+		}
+	}
+}
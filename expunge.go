@@ -0,0 +1,137 @@
+package mbox_reader
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Expunge removes the messages passing the filters of the reader from the
+// mailbox file and returns them. At least one filter has to be set, so a
+// mailbox is never emptied by mistake; messages that can not be parsed are
+// always kept. The mailbox is written to a temporary file next to it, which
+// then replaces the mailbox, all under an exclusive lock. With dryRun the
+// messages are only found, not removed. Afterwards the reader starts over
+// from the first message.
+//
+// flock and fcntl locks belong to the file replaced, so mail delivery agents
+// waiting on them may append to the old file; use LOCK_DOTLOCK, alone or
+// combined, when they also take dot locks.
+func (mboxReader *MboxReader) Expunge(dryRun bool) ([]MboxIndexEntry, error) {
+	return mboxReader.ExpungeContext(context.Background(), dryRun)
+}
+
+// ExpungeContext is Expunge giving up waiting for the mailbox lock when ctx
+// is done.
+func (mboxReader *MboxReader) ExpungeContext(ctx context.Context, dryRun bool) ([]MboxIndexEntry, error) {
+	if mboxReader.file == nil {
+		return nil, ErrNoMailboxFile
+	}
+	if mboxReader.session != nil {
+		return nil, ErrSessionActive
+	}
+	if !mboxReader.hasFilters() {
+		return nil, ErrNoFilters
+	}
+
+	file, lock, err := mboxReader.lockForWriting(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	defer lock.Unlock()
+
+	removed, kept, err := mboxReader.findExpunged(file)
+	if err != nil || dryRun || len(removed) == 0 {
+		return removed, err
+	}
+	err = rewriteMailbox(file, mboxReader.filepath, kept)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = mboxReader.SetFilePath(mboxReader.filepath)
+	return removed, err
+}
+
+// hasFilters reports whether any filter is set on the reader.
+func (mboxReader *MboxReader) hasFilters() bool {
+	return len(mboxReader.headerFilters) > 0 || len(mboxReader.headerRegexFilters) > 0 ||
+		len(mboxReader.addressFilters) > 0 || len(mboxReader.domainFilters) > 0 ||
+		!mboxReader.afterTime.IsZero() || !mboxReader.beforeTime.IsZero() ||
+		len(mboxReader.attachmentNames) > 0 || len(mboxReader.attachmentNameRegexes) > 0 ||
+		mboxReader.requiredFlags != 0 || mboxReader.excludedFlags != 0
+}
+
+// findExpunged scans the mailbox and sorts its messages into those passing
+// the filters and the extents of those to keep.
+func (mboxReader *MboxReader) findExpunged(file *os.File) (removed []MboxIndexEntry, kept []MboxIndexEntry, err error) {
+	reader, err := newFileLineReader(file, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed = make([]MboxIndexEntry, 0)
+	for {
+		msg, err := readMsgContent(reader, mboxReader.format)
+		if err == io.EOF {
+			return removed, kept, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		err = parseMessageWithMode(&msg, mboxReader.parseMode)
+		if err != nil && mboxReader.parseMode == PARSE_MODE_STRICT {
+			return nil, nil, mboxReader.newParseError(&msg, err)
+		}
+		entry := MboxIndexEntry{
+			Offset:    msg.offset,
+			Length:    msg.length,
+			Sender:    msg.sender,
+			Timestamp: msg.timestamp,
+			Line:      msg.line,
+		}
+		if err == nil && mboxReader.matchFilters(&msg) {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+}
+
+// rewriteMailbox writes the kept messages to a temporary file with the mode
+// and owner of the mailbox and renames it over the mailbox.
+func rewriteMailbox(file *os.File, mboxPath string, kept []MboxIndexEntry) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(mboxPath), "."+filepath.Base(mboxPath)+".expunge-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	for _, entry := range kept {
+		_, err = io.Copy(temp, io.NewSectionReader(file, entry.Offset, entry.Length))
+		if err != nil {
+			return err
+		}
+	}
+	err = temp.Chmod(stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	// spool files belong to their users; only root can keep that
+	chownFile(temp, stat)
+	err = temp.Sync()
+	if err != nil {
+		return err
+	}
+	err = temp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), mboxPath)
+}
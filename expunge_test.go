@@ -0,0 +1,103 @@
+package mbox_reader
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpunge(t *testing.T) {
+	mboxPath := filepath.Join(t.TempDir(), "mbox")
+	mboxWriter, err := NewMboxWriter(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	days := []int{40, 10, 35, 1}
+	now := time.Now().UTC().Truncate(time.Second)
+	for ind, age := range days {
+		content := "Subject: message " + string(rune('a'+ind)) + "\n\nBody.\n"
+		err = mboxWriter.Append("sender@example.com", now.AddDate(0, 0, -age), strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mboxWriter.Close()
+	err = os.Chmod(mboxPath, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadFile(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mboxReader.Expunge(false)
+	if !errors.Is(err, ErrNoFilters) {
+		t.Errorf("Expunging without filters must be refused, got:%v\n", err)
+	}
+
+	mboxReader.SetBeforeTime(now.AddDate(0, 0, -30))
+	removed, err := mboxReader.Expunge(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || !removed[0].Timestamp.Equal(now.AddDate(0, 0, -40)) ||
+		!removed[1].Timestamp.Equal(now.AddDate(0, 0, -35)) {
+		t.Errorf("Messages to remove are wrong: %v\n", removed)
+	}
+	unchanged, err := ioutil.ReadFile(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unchanged) != string(original) {
+		t.Error("A dry run must not change the mailbox")
+	}
+
+	removed, err = mboxReader.Expunge(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("Removed messages count is wrong. Want:2, got:%d\n", len(removed))
+	}
+	stat, err := os.Stat(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0640 {
+		t.Errorf("The mailbox mode is not kept: %s\n", stat.Mode())
+	}
+	entries, err := os.ReadDir(filepath.Dir(mboxPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Temporary files are left behind: %v\n", entries)
+	}
+
+	mboxReader.ResetFilters()
+	var subjects []string
+	for {
+		msg, err := mboxReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, _ := msg.Header(H_SUBJECT)
+		subjects = append(subjects, strings.Join(subject.Values, ""))
+	}
+	if strings.Join(subjects, ",") != "message b,message d" {
+		t.Errorf("Messages left are wrong: %v\n", subjects)
+	}
+}
@@ -0,0 +1,308 @@
+package mbox_reader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MessageFlags is the state mail clients record in the Status, X-Status and
+// X-Mozilla-Status headers of a message. Flags can be combined.
+type MessageFlags int
+
+const (
+	// FLAG_SEEN marks a message as read: "R" in Status.
+	FLAG_SEEN MessageFlags = 1 << iota
+	// FLAG_OLD marks a message seen in the mailbox before, read or not: "O"
+	// in Status.
+	FLAG_OLD
+	// FLAG_ANSWERED marks a replied message: "A" in X-Status.
+	FLAG_ANSWERED
+	// FLAG_FLAGGED marks a message flagged as important: "F" in X-Status.
+	FLAG_FLAGGED
+	// FLAG_DELETED marks a message to be expunged: "D" in X-Status.
+	FLAG_DELETED
+	// FLAG_DRAFT marks a draft: "T" in X-Status.
+	FLAG_DRAFT
+	// FLAG_FORWARDED marks a forwarded message. Only X-Mozilla-Status
+	// records it.
+	FLAG_FORWARDED
+)
+
+// statusLetters maps the letters of Status and X-Status to flags.
+var statusLetters = []struct {
+	letter byte
+	flag   MessageFlags
+}{
+	{'R', FLAG_SEEN},
+	{'O', FLAG_OLD},
+	{'A', FLAG_ANSWERED},
+	{'F', FLAG_FLAGGED},
+	{'T', FLAG_DRAFT},
+	{'D', FLAG_DELETED},
+}
+
+// mozillaBits maps the bits of X-Mozilla-Status and X-Mozilla-Status2, as
+// Thunderbird defines them, to flags.
+var mozillaBits = map[string][]struct {
+	bit  uint64
+	flag MessageFlags
+}{
+	H_X_MOZ_STATUS: {
+		{0x0001, FLAG_SEEN},
+		{0x0002, FLAG_ANSWERED},
+		{0x0004, FLAG_FLAGGED},
+		{0x0008, FLAG_DELETED},
+		{0x1000, FLAG_FORWARDED},
+	},
+	H_X_MOZ_STATUS2: {
+		{0x00200000, FLAG_DELETED},
+	},
+}
+
+// Flags decodes the Status, X-Status, X-Mozilla-Status and X-Mozilla-Status2
+// headers of the message. A flag is set when any of them sets it.
+func (message Message) Flags() MessageFlags {
+	var flags MessageFlags
+	for _, name := range []string{H_STATUS, H_X_STATUS, H_X_MOZ_STATUS, H_X_MOZ_STATUS2} {
+		for _, value := range message.headers[name] {
+			flags |= decodeFlags(name, value)
+		}
+	}
+	return flags
+}
+
+// decodeFlags returns the flags set by a single status header.
+func decodeFlags(name string, value string) MessageFlags {
+	var flags MessageFlags
+	value = strings.TrimSpace(value)
+	if bits, ok := mozillaBits[name]; ok {
+		number, err := strconv.ParseUint(value, 16, 32)
+		if err != nil {
+			return 0
+		}
+		for _, mapping := range bits {
+			if number&mapping.bit != 0 {
+				flags |= mapping.flag
+			}
+		}
+		return flags
+	}
+	for _, mapping := range statusLetters {
+		if strings.IndexByte(value, mapping.letter) != -1 {
+			flags |= mapping.flag
+		}
+	}
+	return flags
+}
+
+// encodeFlags returns the value of a status header recording flags. Letters
+// and bits the package does not know are kept from value.
+func encodeFlags(name string, value string, flags MessageFlags) string {
+	value = strings.TrimSpace(value)
+	if bits, ok := mozillaBits[name]; ok {
+		number, _ := strconv.ParseUint(value, 16, 32)
+		for _, mapping := range bits {
+			number &^= mapping.bit
+			if flags&mapping.flag != 0 {
+				number |= mapping.bit
+			}
+		}
+		return fmt.Sprintf("%0*x", len(value), number)
+	}
+
+	// Status holds the read state, X-Status the rest
+	known := "ROAFTD"
+	own := known[2:]
+	if name == H_STATUS {
+		own = known[:2]
+	}
+	var encoded strings.Builder
+	for _, mapping := range statusLetters {
+		if strings.IndexByte(own, mapping.letter) != -1 && flags&mapping.flag != 0 {
+			encoded.WriteByte(mapping.letter)
+		}
+	}
+	for ind := 0; ind < len(value); ind++ {
+		if strings.IndexByte(known, value[ind]) == -1 {
+			encoded.WriteByte(value[ind])
+		}
+	}
+	return encoded.String()
+}
+
+// statusField is a status header of a message in the mailbox file. area is
+// everything after the colon, which an update may overwrite.
+type statusField struct {
+	name   string
+	offset int64
+	area   string
+	folded bool
+}
+
+// SetFlags records flags in the status headers of msg, a message read from
+// the mailbox of the reader, under an exclusive lock. Header values are
+// overwritten in place, padded with spaces, so the mailbox keeps its size
+// and the index of the reader, if any, stays valid. ErrFlagsDoNotFit is
+// returned, with nothing written, when the headers present are too narrow or
+// missing to record flags. Mail clients writing the Status headers pad them
+// for that. The headers of msg are updated to match.
+func (mboxReader *MboxReader) SetFlags(msg *Message, flags MessageFlags) error {
+	return mboxReader.SetFlagsContext(context.Background(), msg, flags)
+}
+
+// SetFlagsContext is SetFlags giving up waiting for the mailbox lock when ctx
+// is done.
+func (mboxReader *MboxReader) SetFlagsContext(ctx context.Context, msg *Message, flags MessageFlags) error {
+	if mboxReader.file == nil {
+		return ErrNoMailboxFile
+	}
+	if mboxReader.session != nil {
+		return ErrSessionActive
+	}
+	if msg.envelope == "" || msg.source != io.ReaderAt(mboxReader.file) {
+		return ErrMessageMoved
+	}
+
+	file, lock, err := mboxReader.lockForWriting(ctx)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	defer lock.Unlock()
+
+	fields, err := findStatusFields(file, msg)
+	if err != nil {
+		return err
+	}
+	areas := make([]string, len(fields))
+	var recorded MessageFlags
+	for ind, field := range fields {
+		value := strings.TrimLeft(field.area, " \t")
+		leading := field.area[:len(field.area)-len(value)]
+		encoded := encodeFlags(field.name, value, flags)
+		if field.folded || len(leading)+len(encoded) > len(field.area) {
+			return ErrFlagsDoNotFit
+		}
+		areas[ind] = leading + encoded + strings.Repeat(" ", len(field.area)-len(leading)-len(encoded))
+		recorded |= decodeFlags(field.name, encoded)
+	}
+	if recorded != flags {
+		return ErrFlagsDoNotFit
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	for ind, field := range fields {
+		if areas[ind] == field.area {
+			continue
+		}
+		_, err = file.WriteAt([]byte(areas[ind]), field.offset)
+		if err != nil {
+			return err
+		}
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	// the offsets stay the same, so an index matching the mailbox before the
+	// write only needs the new modification time
+	index := mboxReader.index
+	if index != nil && index.Size == stat.Size() && index.ModTime.Equal(stat.ModTime()) {
+		stat, err = file.Stat()
+		if err != nil {
+			return err
+		}
+		index.ModTime = stat.ModTime()
+	}
+	msg.updateStatusHeaders(fields, areas)
+	return nil
+}
+
+// findStatusFields reads the headers of msg from the mailbox file, checking
+// the message is still where it was read from.
+func findStatusFields(file *os.File, msg *Message) ([]statusField, error) {
+	reader := newSectionLineReader(file, msg.offset, msg.length)
+	envelope, err := reader.readLine(maxHeaderLineLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if envelope != msg.envelope {
+		return nil, ErrMessageMoved
+	}
+
+	fields := make([]statusField, 0)
+	for {
+		lineStart := reader.offset
+		lineStr, err := reader.readLine(maxHeaderLineLen)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == io.EOF || len(lineStr) == 0 {
+			return fields, nil
+		}
+		hname, _, colonIndex := splitHeaderLine(lineStr)
+		if _, ok := mozillaBits[hname]; !ok && hname != H_STATUS && hname != H_X_STATUS {
+			continue
+		}
+		next, err := reader.peek(1)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, statusField{
+			name:   hname,
+			offset: msg.offset + lineStart + int64(colonIndex) + 1,
+			area:   lineStr[colonIndex+1:],
+			folded: len(next) > 0 && (next[0] == ' ' || next[0] == '\t'),
+		})
+	}
+}
+
+// updateStatusHeaders puts the status header values written to the mailbox
+// into the headers of the message.
+func (message *Message) updateStatusHeaders(fields []statusField, areas []string) {
+	values := make(map[string][]string)
+	for ind, field := range fields {
+		values[field.name] = append(values[field.name], strings.Trim(areas[ind], " \t"))
+	}
+	for name, nameValues := range values {
+		message.headers[name] = nameValues
+	}
+
+	next := 0
+	for ind, field := range message.fields {
+		name := strings.ToUpper(field.Name)
+		if _, ok := values[name]; !ok || next == len(fields) {
+			continue
+		}
+		ending := field.Raw[len(trimLineEnd(field.Raw)):]
+		message.fields[ind].Raw = field.Name + ":" + areas[next] + ending
+		next++
+	}
+}
+
+// WithFlags skips messages that do not have all of flags set.
+func (mboxReader *MboxReader) WithFlags(flags MessageFlags) *MboxReader {
+	mboxReader.requiredFlags |= flags
+	return mboxReader
+}
+
+// WithoutFlags skips messages that have any of flags set, as
+// WithoutFlags(FLAG_SEEN) does for read messages or
+// WithoutFlags(FLAG_DELETED) for deleted ones.
+func (mboxReader *MboxReader) WithoutFlags(flags MessageFlags) *MboxReader {
+	mboxReader.excludedFlags |= flags
+	return mboxReader
+}
+
+// matchFlagFilters reports whether the message passes the flag filters.
+func (mboxReader *MboxReader) matchFlagFilters(msg *Message) bool {
+	flags := msg.Flags()
+	return flags&mboxReader.requiredFlags == mboxReader.requiredFlags && flags&mboxReader.excludedFlags == 0
+}
@@ -0,0 +1,235 @@
+package mbox_reader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var flagNames = map[string]MessageFlags{
+	"seen":      FLAG_SEEN,
+	"old":       FLAG_OLD,
+	"answered":  FLAG_ANSWERED,
+	"flagged":   FLAG_FLAGGED,
+	"deleted":   FLAG_DELETED,
+	"draft":     FLAG_DRAFT,
+	"forwarded": FLAG_FORWARDED,
+}
+
+func parseFlagNames(names []string) MessageFlags {
+	var flags MessageFlags
+	for _, name := range names {
+		flags |= flagNames[name]
+	}
+	return flags
+}
+
+func TestMessageFlags(t *testing.T) {
+	type MessageFlagsTestCase struct {
+		FilePath string     `json:"filepath"`
+		With     []string   `json:"with"`
+		Without  []string   `json:"without"`
+		Subjects []string   `json:"subjects"`
+		Flags    [][]string `json:"flags"`
+	}
+
+	testTable := make([]MessageFlagsTestCase, 5)
+	data, err := ioutil.ReadFile("testcases/message_flags_cases.json")
+	if err != nil {
+		t.Errorf("Couldn't open a file with testcases %e", err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			mboxReader, err := NewMboxReader("testcases/distinct-messages/"+tcase.FilePath, 1, 0)
+			if err != nil {
+				t.Fatalf("Couldn't open the file %e", err)
+			}
+			mboxReader.WithFlags(parseFlagNames(tcase.With)).WithoutFlags(parseFlagNames(tcase.Without))
+
+			subjects := make([]string, 0)
+			flags := make([]MessageFlags, 0)
+			for {
+				msg, err := mboxReader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				subject, _ := msg.Header(H_SUBJECT)
+				subjects = append(subjects, strings.Join(subject.Values, ""))
+				flags = append(flags, msg.Flags())
+			}
+			wantFlags := make([]MessageFlags, 0)
+			for _, names := range tcase.Flags {
+				wantFlags = append(wantFlags, parseFlagNames(names))
+			}
+
+			if fmt.Sprint(subjects) != fmt.Sprint(tcase.Subjects) {
+				t.Errorf("Subjects are wrong. Want:%v, got:%v\n", tcase.Subjects, subjects)
+			}
+			if fmt.Sprint(flags) != fmt.Sprint(wantFlags) {
+				t.Errorf("Flags are wrong. Want:%v, got:%v\n", wantFlags, flags)
+			}
+		})
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	mboxPath := copyMailbox(t, "flags.mbox")
+	original, err := ioutil.ReadFile(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]*Message, 0)
+	for {
+		msg, err := mboxReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, msg)
+	}
+
+	// "Status: O" has no room for "R", nor a message without status headers
+	err = mboxReader.SetFlags(messages[1], FLAG_SEEN|FLAG_OLD)
+	if !errors.Is(err, ErrFlagsDoNotFit) {
+		t.Errorf("Flags not fitting must be refused, got:%v\n", err)
+	}
+	err = mboxReader.SetFlags(messages[3], FLAG_SEEN)
+	if !errors.Is(err, ErrFlagsDoNotFit) {
+		t.Errorf("Flags without headers must be refused, got:%v\n", err)
+	}
+	unchanged, err := ioutil.ReadFile(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unchanged) != string(original) {
+		t.Error("Refused flags must not change the mailbox")
+	}
+
+	updates := map[int]MessageFlags{
+		0: FLAG_OLD | FLAG_FLAGGED,
+		1: 0,
+		2: FLAG_SEEN,
+		4: FLAG_SEEN | FLAG_OLD | FLAG_ANSWERED | FLAG_DRAFT,
+	}
+	for ind, flags := range updates {
+		err = mboxReader.SetFlags(messages[ind], flags)
+		if err != nil {
+			t.Fatalf("Message %d: %v", ind, err)
+		}
+		if messages[ind].Flags() != flags {
+			t.Errorf("Message %d flags are not updated. Want:%v, got:%v\n", ind, flags, messages[ind].Flags())
+		}
+	}
+	status := messages[0].HeaderFieldsByName(H_STATUS)
+	if len(status) != 1 || status[0].Raw != "Status: O \n" {
+		t.Errorf("Status field is not updated: %q\n", status)
+	}
+
+	updated, err := ioutil.ReadFile(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated) != len(original) {
+		t.Errorf("Mailbox size changed. Want:%d, got:%d\n", len(original), len(updated))
+	}
+	rereader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ind := 0; ; ind++ {
+		msg, err := rereader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := messages[ind].Flags()
+		if msg.Flags() != want {
+			t.Errorf("Message %d flags are not written. Want:%v, got:%v\n", ind, want, msg.Flags())
+		}
+		body, _ := msg.Body(CT_TXT_PLAIN)
+		wantBody, _ := messages[ind].Body(CT_TXT_PLAIN)
+		if body != wantBody {
+			t.Errorf("Message %d body changed: %q\n", ind, body)
+		}
+	}
+
+	streamReader := NewMboxReaderFromReader(strings.NewReader(string(original)))
+	msg, err := streamReader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = streamReader.SetFlags(msg, FLAG_SEEN)
+	if !errors.Is(err, ErrNoMailboxFile) {
+		t.Errorf("Flags of a stream can not be set, got:%v\n", err)
+	}
+}
+
+func TestSetFlagsKeepsIndex(t *testing.T) {
+	mboxPath := copyMailbox(t, "flags.mbox")
+	// an mtime well in the past tells it from the time of the update
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err := os.Chtimes(mboxPath, past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mboxReader.BuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mboxReader.ReadMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mboxReader.SetFlags(msg, FLAG_SEEN|FLAG_OLD|FLAG_DELETED)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.ModTime().Equal(past) {
+		t.Error("The mailbox mtime must change after setting flags")
+	}
+	if mboxReader.index == nil || !mboxReader.index.IsValid(mboxPath) {
+		t.Error("The index of the reader must stay valid after setting flags")
+	}
+	err = mboxReader.SeekMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = mboxReader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Flags() != FLAG_SEEN|FLAG_OLD|FLAG_DELETED {
+		t.Errorf("Flags are not written. Want:%v, got:%v\n", FLAG_SEEN|FLAG_OLD|FLAG_DELETED, msg.Flags())
+	}
+}
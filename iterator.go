@@ -0,0 +1,34 @@
+//go:build go1.23
+
+package mbox_reader
+
+import (
+	"io"
+	"iter"
+)
+
+// All returns an iterator over the messages passing the reader filters,
+// to be used with a range loop:
+//
+//	for msg, err := range mboxReader.All() {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// The iteration ends after the last message or after yielding an error,
+// and stops reading as soon as the loop is left.
+func (mboxReader *MboxReader) All() iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		for {
+			msg, err := mboxReader.Read()
+			if err == io.EOF {
+				return
+			}
+			if !yield(msg, err) || err != nil {
+				return
+			}
+		}
+	}
+}
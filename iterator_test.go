@@ -0,0 +1,47 @@
+//go:build go1.23
+
+package mbox_reader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	var stream bytes.Buffer
+	for _, file := range []string{"message1.mbox", "reader-test-msg-1.mbox", "message1.mbox"} {
+		data, err := ioutil.ReadFile("testcases/distinct-messages/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write(data)
+		stream.WriteString("\n\n")
+	}
+	data := stream.Bytes()
+
+	var msgFound int
+	for msg, err := range NewMboxReaderFromReader(bytes.NewReader(data)).All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			t.Fatal("A nil message is yielded without an error")
+		}
+		msgFound += 1
+	}
+	if msgFound != 3 {
+		t.Errorf("Messages count is wrong. Want:%d, got:%d\n", 3, msgFound)
+	}
+
+	msgFound = 0
+	for range NewMboxReaderFromReader(bytes.NewReader(data)).All() {
+		msgFound += 1
+		if msgFound == 2 {
+			break
+		}
+	}
+	if msgFound != 2 {
+		t.Errorf("The iteration did not stop. Want:%d, got:%d\n", 2, msgFound)
+	}
+}
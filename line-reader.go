@@ -0,0 +1,299 @@
+package mbox_reader
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// readerBufferSize is the size of the lookahead window of a lineReader.
+const readerBufferSize = 64 * 1024
+
+// maxHeaderLineLen limits how much of a single header line is kept.
+const maxHeaderLineLen = 1024 * 1024
+
+// maxBoundaryLineLen limits how much of a body line is kept to compare it
+// with a boundary. Boundaries are at most 70 characters long.
+const maxBoundaryLineLen = 1024
+
+// lineReader reads an mbox stream line by line while keeping at most a
+// bounded prefix of every line, so lines of any length can be read in
+// constant memory. offset is the position of the next line in the stream
+// and line its one-based number, or 0 when it is not known.
+//
+// A file is read again later through source, and can be rewound by seeking.
+// Reading a file can be limited to its first limit bytes. A plain stream can
+// be neither, so the bytes of the message being read are recorded instead,
+// and rewinding puts them into pending, which is read before the stream.
+type lineReader struct {
+	reader      *bufio.Reader
+	pending     []byte
+	spare       []byte
+	peeked      []byte
+	file        io.ReadSeeker
+	source      io.ReaderAt
+	offset      int64
+	line        int
+	limited     bool
+	limit       int64
+	lastEnding  int
+	recording   bool
+	record      []byte
+	recordStart int64
+}
+
+// newLineReader creates a reader over a stream that is never seeked.
+func newLineReader(reader io.Reader) *lineReader {
+	return &lineReader{
+		reader:    bufio.NewReaderSize(reader, readerBufferSize),
+		line:      1,
+		recording: true,
+	}
+}
+
+// newFileLineReader creates a reader over a mailbox file starting at offset.
+// Line numbers are only known when reading from the start.
+func newFileLineReader(file *os.File, offset int64) (*lineReader, error) {
+	_, err := file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	reader := &lineReader{
+		reader: bufio.NewReaderSize(file, readerBufferSize),
+		file:   file,
+		source: file,
+		offset: offset,
+	}
+	if offset == 0 {
+		reader.line = 1
+	}
+	return reader, nil
+}
+
+// newSectionLineReader creates a reader over length bytes of source starting
+// at start. Offsets of the reader are relative to start.
+func newSectionLineReader(source io.ReaderAt, start int64, length int64) *lineReader {
+	return &lineReader{
+		reader: bufio.NewReaderSize(io.NewSectionReader(source, start, length), readerBufferSize),
+	}
+}
+
+// readLine consumes the next line and returns at most limit bytes of it,
+// without the line terminator. io.EOF is returned only when there is
+// nothing left to read.
+func (reader *lineReader) readLine(limit int) (string, error) {
+	var line []byte
+	var length int
+	var lastChunk []byte
+	for {
+		chunk, err := reader.readChunk()
+		length += len(chunk)
+		if reader.recording {
+			reader.record = append(reader.record, chunk...)
+		}
+		if len(line) < limit {
+			kept := chunk
+			if len(line)+len(kept) > limit {
+				kept = kept[:limit-len(line)]
+			}
+			line = append(line, kept...)
+		}
+		if len(chunk) > 0 {
+			lastChunk = chunk
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		reader.offset += int64(length)
+		if err == io.EOF && length > 0 {
+			err = nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if reader.line > 0 {
+			reader.line++
+		}
+		reader.lastEnding = len(lastChunk) - len(trimLineEnd(string(lastChunk)))
+		return trimLineEnd(string(line)), nil
+	}
+}
+
+// readChunk reads up to the next line break as bufio.Reader.ReadSlice does,
+// pending bytes first.
+func (reader *lineReader) readChunk() ([]byte, error) {
+	if len(reader.pending) == 0 {
+		return reader.reader.ReadSlice('\n')
+	}
+	size := len(reader.pending)
+	if idx := bytes.IndexByte(reader.pending, '\n'); idx != -1 {
+		size = idx + 1
+	}
+	chunk := reader.pending[:size]
+	reader.pending = reader.pending[size:]
+	if chunk[len(chunk)-1] != '\n' {
+		// the line goes on in the stream
+		return chunk, bufio.ErrBufferFull
+	}
+	return chunk, nil
+}
+
+// skipLine consumes the next line without keeping any of it.
+func (reader *lineReader) skipLine() error {
+	_, err := reader.readLine(0)
+	return err
+}
+
+// discard consumes up to count bytes and returns how many were consumed.
+func (reader *lineReader) discard(count int64) (int64, error) {
+	var discarded int64
+	for discarded < count {
+		size := count - discarded
+		if size > readerBufferSize {
+			size = readerBufferSize
+		}
+		var chunk []byte
+		var err error
+		fromPending := len(reader.pending) > 0
+		if fromPending {
+			chunk = reader.pending[:min(int64(len(reader.pending)), size)]
+			reader.pending = reader.pending[len(chunk):]
+		} else {
+			chunk, err = reader.reader.Peek(int(size))
+		}
+		if reader.recording {
+			reader.record = append(reader.record, chunk...)
+		}
+		if !fromPending {
+			reader.reader.Discard(len(chunk))
+		}
+		if reader.line > 0 {
+			reader.line += bytes.Count(chunk, []byte("\n"))
+		}
+		discarded += int64(len(chunk))
+		reader.offset += int64(len(chunk))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return discarded, err
+		}
+	}
+	return discarded, nil
+}
+
+// peek returns up to count upcoming bytes without consuming them. Fewer
+// bytes are returned without an error at the end of the stream.
+func (reader *lineReader) peek(count int) ([]byte, error) {
+	if len(reader.pending) >= count {
+		return reader.pending[:count], nil
+	}
+	data, err := reader.reader.Peek(count - len(reader.pending))
+	if err == io.EOF {
+		err = nil
+	}
+	if len(reader.pending) == 0 {
+		return data, err
+	}
+	reader.peeked = append(append(reader.peeked[:0], reader.pending...), data...)
+	return reader.peeked, err
+}
+
+func (reader *lineReader) atEOF() (bool, error) {
+	next, err := reader.peek(1)
+	return len(next) == 0, err
+}
+
+func (reader *lineReader) nextLineIsFrom() (bool, error) {
+	next, err := reader.peek(len("From "))
+	return reachedNewMessage(string(next)), err
+}
+
+func (reader *lineReader) nextLineIsBlank() (bool, error) {
+	next, err := reader.peek(2)
+	return bytes.HasPrefix(next, []byte("\n")) || bytes.HasPrefix(next, []byte("\r\n")), err
+}
+
+// reachedMessageEnd reports whether only blank lines are left before the
+// next From_ line or the end of the stream. Nothing is consumed, and blank
+// lines that do not fit into the lookahead window are not looked past.
+func (reader *lineReader) reachedMessageEnd() (bool, error) {
+	window, err := reader.peek(readerBufferSize)
+	if err != nil {
+		return false, err
+	}
+	full := len(window) == readerBufferSize
+	for len(window) > 0 {
+		if bytes.HasPrefix(window, []byte("\n")) {
+			window = window[1:]
+		} else if bytes.HasPrefix(window, []byte("\r\n")) {
+			window = window[2:]
+		} else {
+			return reachedNewMessage(string(window[:min(len(window), len("From "))])), nil
+		}
+	}
+	return !full, nil
+}
+
+// startRecording drops what was recorded so far and records from the current offset.
+func (reader *lineReader) startRecording() {
+	reader.record = nil
+	reader.recordStart = reader.offset
+}
+
+// takeRecord returns the recorded bytes and stops holding them.
+func (reader *lineReader) takeRecord() []byte {
+	record := reader.record
+	reader.record = nil
+	return record
+}
+
+// rewind moves the reader back to an earlier offset and line: a file is
+// seeked, a stream gets the recorded bytes pushed back.
+func (reader *lineReader) rewind(offset int64, line int) error {
+	if reader.file != nil {
+		_, err := reader.file.Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		reader.reader.Reset(reader.input(offset))
+		reader.offset = offset
+		reader.line = line
+		return nil
+	}
+	if !reader.recording || offset < reader.recordStart || offset > reader.offset {
+		return ErrNotRewindable
+	}
+	recorded := offset - reader.recordStart
+	// pending bytes not read yet follow the pushed back ones
+	pending := append(append(reader.spare[:0], reader.record[recorded:]...), reader.pending...)
+	reader.spare = reader.pending[:0]
+	reader.pending = pending
+	reader.record = reader.record[:recorded]
+	reader.offset = offset
+	reader.line = line
+	return nil
+}
+
+// limitTo makes a file reader stop at end as if the file ended there. A
+// negative end removes the limit.
+func (reader *lineReader) limitTo(end int64) error {
+	reader.limited = end >= 0
+	reader.limit = end
+	return reader.rewind(reader.offset, reader.line)
+}
+
+// input returns the file positioned at offset, cut at the limit if any.
+func (reader *lineReader) input(offset int64) io.Reader {
+	if !reader.limited {
+		return reader.file
+	}
+	return io.LimitReader(reader.file, max(reader.limit-offset, 0))
+}
+
+func trimLineEnd(line string) string {
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r")
+}
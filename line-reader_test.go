@@ -0,0 +1,83 @@
+package mbox_reader
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineReaderRewindStream(t *testing.T) {
+	const rewinds = 10000
+	var stream strings.Builder
+	for ind := 0; ind < rewinds; ind++ {
+		fmt.Fprintf(&stream, "line %d\nsecond line %d\n", ind, ind)
+	}
+	reader := newLineReader(strings.NewReader(stream.String()))
+	buffered := reader.reader
+
+	for ind := 0; ind < rewinds; ind++ {
+		reader.startRecording()
+		offset, line := reader.offset, reader.line
+		for pass := 0; pass < 2; pass++ {
+			first, err := reader.readLine(maxHeaderLineLen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pass == 0 {
+				err = reader.rewind(offset, line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			second, err := reader.readLine(maxHeaderLineLen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != fmt.Sprintf("line %d", ind) || second != fmt.Sprintf("second line %d", ind) {
+				t.Fatalf("Lines read after rewind %d are wrong: %q, %q\n", ind, first, second)
+			}
+		}
+		if reader.line != 2*ind+3 {
+			t.Fatalf("Line number after rewind %d is wrong. Want:%d, got:%d\n", ind, 2*ind+3, reader.line)
+		}
+	}
+	if _, err := reader.readLine(maxHeaderLineLen); err != io.EOF {
+		t.Errorf("The stream must end, got:%v\n", err)
+	}
+	if reader.reader != buffered {
+		t.Error("Rewinding must not wrap the buffered reader")
+	}
+}
+
+func TestReadStreamWrongContentLength(t *testing.T) {
+	const count = 5000
+	var stream strings.Builder
+	for ind := 0; ind < count; ind++ {
+		fmt.Fprintf(&stream, "From sender@example.com  Mon Mar  2 10:00:00 2020\n"+
+			"Subject: message %d\nContent-Length: 3\n\nBody.\n\n", ind)
+	}
+	mboxReader := NewMboxReaderFromReader(strings.NewReader(stream.String()))
+	buffered := mboxReader.reader.reader
+
+	for ind := 0; ; ind++ {
+		msg, err := mboxReader.Read()
+		if err == io.EOF {
+			if ind != count {
+				t.Errorf("Messages count is wrong. Want:%d, got:%d\n", count, ind)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, _ := msg.Header(H_SUBJECT)
+		if strings.Join(subject.Values, "") != fmt.Sprintf("message %d", ind) {
+			t.Fatalf("Message %d has a wrong subject: %v\n", ind, subject.Values)
+		}
+	}
+	if mboxReader.reader.reader != buffered {
+		t.Error("Rewinding must not wrap the buffered reader")
+	}
+}
@@ -0,0 +1,204 @@
+package mbox_reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// LockStrategy tells how a mailbox file is locked. Strategies are flags and
+// can be combined, as LOCK_DOTLOCK|LOCK_FCNTL for what postfix and procmail
+// do by default.
+type LockStrategy int
+
+const (
+	// LOCK_NONE does not lock the mailbox at all.
+	LOCK_NONE LockStrategy = 0
+	// LOCK_FLOCK uses flock(2) on the mailbox file. It is the default.
+	LOCK_FLOCK LockStrategy = 1 << iota
+	// LOCK_FCNTL uses fcntl(2) record locks on the whole mailbox file. It is
+	// only available on unix systems.
+	LOCK_FCNTL
+	// LOCK_DOTLOCK creates a "<mailbox>.lock" file next to the mailbox. It is
+	// always exclusive and needs write access to the mailbox directory.
+	LOCK_DOTLOCK
+)
+
+// DOTLOCK_STALE_AGE is how old a dot lock file has to be to be taken as left
+// behind by a crashed process and removed, as procmail does.
+const DOTLOCK_STALE_AGE = 1024 * time.Second
+
+// lockBackoffMin and lockBackoffMax bound the pause between lock trials,
+// which doubles after every failed trial.
+const lockBackoffMin = 10 * time.Millisecond
+const lockBackoffMax = time.Second
+
+// mboxLock is a lock of a mailbox file taken with one or more strategies.
+type mboxLock struct {
+	strategy  LockStrategy
+	file      *os.File
+	filepath  string
+	flock     *flock.Flock
+	fcntlHeld bool
+	dotlock   string
+}
+
+func newMboxLock(strategy LockStrategy, file *os.File, filepath string) *mboxLock {
+	return &mboxLock{
+		strategy: strategy,
+		file:     file,
+		filepath: filepath,
+	}
+}
+
+// tryLock takes all locks of the strategy without waiting. It returns false
+// when one of them is held by someone else, releasing those already taken.
+// A shared lock lets other readers in; a dot lock is exclusive anyway.
+func (lock *mboxLock) tryLock(exclusive bool) (bool, error) {
+	// the dot lock goes first, as mail delivery agents take it first
+	if lock.strategy&LOCK_DOTLOCK != 0 {
+		locked, err := lock.tryDotlock()
+		if err != nil || !locked {
+			return false, err
+		}
+	}
+	if lock.strategy&LOCK_FCNTL != 0 {
+		locked, err := tryFcntlLock(lock.file, exclusive)
+		if err != nil || !locked {
+			lock.Unlock()
+			return false, err
+		}
+		lock.fcntlHeld = true
+	}
+	if lock.strategy&LOCK_FLOCK != 0 {
+		lock.flock = flock.New(lock.filepath)
+		var locked bool
+		var err error
+		if exclusive {
+			locked, err = lock.flock.TryLock()
+		} else {
+			locked, err = lock.flock.TryRLock()
+		}
+		if err != nil || !locked {
+			lock.Unlock()
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// tryDotlock creates the dot lock file, removing a stale one first.
+func (lock *mboxLock) tryDotlock() (bool, error) {
+	dotlock := lock.filepath + ".lock"
+	file, err := os.OpenFile(dotlock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		stat, statErr := os.Stat(dotlock)
+		if statErr != nil || time.Since(stat.ModTime()) < DOTLOCK_STALE_AGE {
+			return false, nil
+		}
+		os.Remove(dotlock)
+		file, err = os.OpenFile(dotlock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dotlock)
+		return false, err
+	}
+	lock.dotlock = dotlock
+	return true, nil
+}
+
+// touch refreshes the modification time of the dot lock file, if one is
+// held, so it is not taken as stale while it is still in use.
+func (lock *mboxLock) touch() error {
+	if lock.dotlock == "" {
+		return nil
+	}
+	now := time.Now()
+	return os.Chtimes(lock.dotlock, now, now)
+}
+
+// Unlock releases the locks held, in the reverse order of taking them.
+func (lock *mboxLock) Unlock() error {
+	var errs []error
+	if lock.flock != nil {
+		errs = append(errs, lock.flock.Unlock())
+		lock.flock = nil
+	}
+	if lock.fcntlHeld {
+		errs = append(errs, unlockFcntl(lock.file))
+		lock.fcntlHeld = false
+	}
+	if lock.dotlock != "" {
+		errs = append(errs, os.Remove(lock.dotlock))
+		lock.dotlock = ""
+	}
+	return errors.Join(errs...)
+}
+
+// lockForWriting opens the mailbox file of the reader for writing and locks
+// it exclusively. The caller unlocks the lock and then closes the file.
+func (mboxReader *MboxReader) lockForWriting(ctx context.Context) (*os.File, *mboxLock, error) {
+	// an exclusive fcntl lock needs a descriptor open for writing
+	file, err := os.OpenFile(mboxReader.filepath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	lock := newMboxLock(mboxReader.lockStrategy, file, mboxReader.filepath)
+	_, err = acquireLock(ctx, lock, true, mboxReader.lockTrialsCount, mboxReader.lockTrialsTimeout)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, lock, nil
+}
+
+// acquireLock locks a mailbox file, trying up to trialsCount more times with
+// a growing pause between trials until ctx is done or, unless it is 0,
+// trialsTimeout milliseconds have passed. An error wrapping ErrLocked is
+// returned when the lock could not be taken in time.
+func acquireLock(ctx context.Context, lock *mboxLock, exclusive bool,
+	trialsCount uint, trialsTimeout uint) (*mboxLock, error) {
+
+	if trialsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(trialsTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	delay := lockBackoffMin
+	for trial := uint(0); ; trial++ {
+		locked, err := lock.tryLock(exclusive)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return lock, nil
+		}
+		if trial >= trialsCount {
+			return nil, ErrLocked
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: %w", ErrLocked, ctx.Err())
+		case <-timer.C:
+		}
+		delay = min(delay*2, lockBackoffMax)
+	}
+}
@@ -0,0 +1,120 @@
+package mbox_reader
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// copyMailbox copies a test mailbox into a temporary directory.
+func copyMailbox(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile("testcases/distinct-messages/" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxPath := filepath.Join(t.TempDir(), "mbox")
+	err = ioutil.WriteFile(mboxPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mboxPath
+}
+
+func TestLockStrategies(t *testing.T) {
+	strategies := []LockStrategy{LOCK_NONE, LOCK_FLOCK, LOCK_FCNTL, LOCK_DOTLOCK,
+		LOCK_DOTLOCK | LOCK_FCNTL, LOCK_DOTLOCK | LOCK_FLOCK | LOCK_FCNTL}
+	for _, strategy := range strategies {
+		mboxPath := copyMailbox(t, "message1.mbox")
+		mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = mboxReader.SetLockStrategy(strategy).Read()
+		if err != nil {
+			t.Errorf("Reading with strategy %d failed: %v\n", strategy, err)
+		}
+		if _, err := os.Stat(mboxPath + ".lock"); !os.IsNotExist(err) {
+			t.Errorf("The dot lock is left behind with strategy %d\n", strategy)
+		}
+	}
+}
+
+func TestLockHeldByOthers(t *testing.T) {
+	mboxPath := copyMailbox(t, "message1.mbox")
+
+	err := ioutil.WriteFile(mboxPath+".lock", []byte("1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxReader, err := NewMboxReader(mboxPath, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxReader.SetLockStrategy(LOCK_DOTLOCK)
+	_, err = mboxReader.Read()
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("A held dot lock must not be taken, got:%v\n", err)
+	}
+
+	mboxReader, err = NewMboxReader(mboxPath, 1000, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxReader.SetLockStrategy(LOCK_DOTLOCK)
+	started := time.Now()
+	_, err = mboxReader.Read()
+	if !errors.Is(err, ErrLocked) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Waiting for the lock must time out, got:%v\n", err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("The lock timeout is not kept, waited %s\n", time.Since(started))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = mboxReader.ReadContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Waiting for the lock must stop with the context, got:%v\n", err)
+	}
+
+	old := time.Now().Add(-2 * DOTLOCK_STALE_AGE)
+	err = os.Chtimes(mboxPath+".lock", old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mboxReader.Read()
+	if err != nil {
+		t.Errorf("A stale dot lock must be removed, got:%v\n", err)
+	}
+
+	other := flock.New(mboxPath)
+	locked, err := other.TryLock()
+	if err != nil || !locked {
+		t.Fatalf("Couldn't lock the mailbox: %v\n", err)
+	}
+	mboxReader, err = NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mboxReader.Read()
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("An exclusive flock must keep readers out, got:%v\n", err)
+	}
+	other.Unlock()
+
+	locked, err = other.TryRLock()
+	if err != nil || !locked {
+		t.Fatalf("Couldn't lock the mailbox: %v\n", err)
+	}
+	defer other.Unlock()
+	_, err = mboxReader.Read()
+	if err != nil {
+		t.Errorf("A shared flock must let readers in, got:%v\n", err)
+	}
+}
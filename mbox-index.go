@@ -0,0 +1,205 @@
+package mbox_reader
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// MboxIndexEntry tells where a message is stored in the mailbox.
+type MboxIndexEntry struct {
+	Offset    int64     `json:"offset"`
+	Length    int64     `json:"length"`
+	Sender    string    `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+	Line      int       `json:"line,omitempty"`
+}
+
+// MboxIndex lists the messages of a mailbox file by their byte offsets. It
+// remembers the size and modification time of the file it was built for and
+// is no longer valid once either of them changes.
+type MboxIndex struct {
+	Size    int64            `json:"size"`
+	ModTime time.Time        `json:"mtime"`
+	Format  MboxFormat       `json:"format"`
+	Entries []MboxIndexEntry `json:"entries"`
+}
+
+// MboxIndexPath returns the path of the sidecar index file of a mailbox.
+func MboxIndexPath(filepath string) string {
+	return filepath + ".idx"
+}
+
+// LoadMboxIndex reads an index saved with Save.
+func LoadMboxIndex(indexPath string) (*MboxIndex, error) {
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	index := &MboxIndex{}
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Save writes the index to indexPath, usually MboxIndexPath of the mailbox.
+func (index *MboxIndex) Save(indexPath string) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexPath, data, 0644)
+}
+
+// IsValid reports whether the mailbox at filepath still has the size and
+// modification time it had when the index was built.
+func (index *MboxIndex) IsValid(filepath string) bool {
+	stat, err := os.Stat(filepath)
+	if err != nil {
+		return false
+	}
+	return stat.Size() == index.Size && stat.ModTime().Equal(index.ModTime)
+}
+
+// BuildIndex scans the whole mailbox file and records where every message
+// is stored, regardless of the filters. The index is also set on the reader
+// and the reader is rewound to the first message. Unless the parse mode is
+// PARSE_MODE_STRICT, messages with a malformed From_ line are indexed too,
+// with the sender and timestamp that could be read.
+func (mboxReader *MboxReader) BuildIndex() (*MboxIndex, error) {
+	if mboxReader.file == nil {
+		return nil, ErrNoMailboxFile
+	}
+	filelock, err := mboxReader.lockFile(context.Background(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer filelock.Unlock()
+
+	stat, err := mboxReader.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	index := &MboxIndex{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Format:  mboxReader.format,
+		Entries: make([]MboxIndexEntry, 0),
+	}
+
+	err = mboxReader.seekTo(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := mboxReader.readMsgContent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sender, timestamp, err := parseMessagePrefix(msg.envelope)
+		if err != nil && mboxReader.parseMode == PARSE_MODE_STRICT {
+			return nil, mboxReader.newParseError(&msg, err)
+		}
+		index.Entries = append(index.Entries, MboxIndexEntry{
+			Offset:    msg.offset,
+			Length:    msg.length,
+			Sender:    sender,
+			Timestamp: timestamp,
+			Line:      msg.line,
+		})
+	}
+
+	err = mboxReader.seekTo(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	mboxReader.index = index
+	return index, nil
+}
+
+// SetIndex makes the reader use a previously built index. An index that is
+// out of date for the mailbox file or was built for another format, and so
+// delimits messages differently, is refused.
+func (mboxReader *MboxReader) SetIndex(index *MboxIndex) error {
+	if mboxReader.file == nil {
+		return ErrNoMailboxFile
+	}
+	if index.Format != mboxReader.format {
+		return ErrIndexFormat
+	}
+	if !index.IsValid(mboxReader.filepath) {
+		return ErrIndexOutOfDate
+	}
+	mboxReader.index = index
+	return nil
+}
+
+// SeekMessage moves the reader to the message with the given zero-based
+// number in the index, so the next Read starts from it.
+func (mboxReader *MboxReader) SeekMessage(number int) error {
+	if mboxReader.index == nil {
+		return ErrNoIndex
+	}
+	if !mboxReader.index.IsValid(mboxReader.filepath) {
+		mboxReader.index = nil
+		return ErrIndexOutOfDate
+	}
+	if number < 0 || number >= len(mboxReader.index.Entries) {
+		return ErrIndexOutOfRange
+	}
+	return mboxReader.seekTo(mboxReader.index.Entries[number].Offset, number)
+}
+
+// ReadMessage returns the message with the given zero-based number in the
+// index without applying the filters. Reading continues after it. A message
+// that can not be parsed is returned as an error in every parse mode, but in
+// PARSE_MODE_LENIENT the message is parsed with warnings where possible.
+func (mboxReader *MboxReader) ReadMessage(number int) (*Message, error) {
+	err := mboxReader.SeekMessage(number)
+	if err != nil {
+		return nil, err
+	}
+	filelock, err := mboxReader.lockFile(context.Background(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer filelock.Unlock()
+
+	msg, err := mboxReader.readMsgContent()
+	if err != nil {
+		return nil, err
+	}
+	err = parseMessageWithMode(&msg, mboxReader.parseMode)
+	if err != nil {
+		return nil, mboxReader.newParseError(&msg, err)
+	}
+	return &msg, nil
+}
+
+// seekTo moves the reader to the message with the given number at offset.
+func (mboxReader *MboxReader) seekTo(offset int64, number int) error {
+	reader, err := newFileLineReader(mboxReader.file, offset)
+	if err != nil {
+		return err
+	}
+	if mboxReader.index != nil && number < len(mboxReader.index.Entries) && offset > 0 {
+		reader.line = mboxReader.index.Entries[number].Line
+	}
+	if mboxReader.session != nil {
+		err = reader.limitTo(mboxReader.snapshotSize)
+		if err != nil {
+			return err
+		}
+	}
+	mboxReader.reader = reader
+	mboxReader.nextNumber = number
+	return nil
+}
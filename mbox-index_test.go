@@ -0,0 +1,124 @@
+package mbox_reader
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMboxIndex(t *testing.T) {
+	var stream bytes.Buffer
+	files := []string{"message1.mbox", "reader-test-msg-1.mbox", "mboxrd.mbox"}
+	for _, file := range files {
+		data, err := ioutil.ReadFile("testcases/distinct-messages/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write(data)
+		stream.WriteString("\n\n")
+	}
+	mboxPath := filepath.Join(t.TempDir(), "mbox")
+	err := ioutil.WriteFile(mboxPath, stream.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := mboxReader.BuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSenders := []string{"randsender@mail.com", "randsender@mail.com", "first@mail.com", "second@mail.com"}
+	if len(index.Entries) != len(wantSenders) {
+		t.Fatalf("Entries count is wrong. Want:%d, got:%d\n", len(wantSenders), len(index.Entries))
+	}
+	var nextOffset int64
+	for ind, entry := range index.Entries {
+		if entry.Sender != wantSenders[ind] {
+			t.Errorf("Entry %d sender is wrong. Want:%s, got:%s\n", ind, wantSenders[ind], entry.Sender)
+		}
+		if entry.Offset != nextOffset {
+			t.Errorf("Entry %d offset is wrong. Want:%d, got:%d\n", ind, nextOffset, entry.Offset)
+		}
+		nextOffset = entry.Offset + entry.Length
+	}
+	if nextOffset != int64(stream.Len()) {
+		t.Errorf("Entries do not cover the mailbox. Want:%d, got:%d\n", stream.Len(), nextOffset)
+	}
+
+	indexPath := MboxIndexPath(mboxPath)
+	err = index.Save(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMboxIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mboxReader, err = NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxReader.SetFormat(MBOX_FMT_MBOXCL2)
+	err = mboxReader.SetIndex(loaded)
+	if !errors.Is(err, ErrIndexFormat) {
+		t.Errorf("An index of another format must be refused, got:%v\n", err)
+	}
+	mboxReader.SetFormat(MBOX_FMT_AUTO)
+	err = mboxReader.SetIndex(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mboxReader.ReadMessage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := msg.Header(H_SUBJECT)
+	if len(subject.Values) != 1 || subject.Values[0] != "rd message 1" {
+		t.Errorf("Read a wrong message: %v\n", subject.Values)
+	}
+	msg, err = mboxReader.Read()
+	if err != nil || msg.Sender() != "second@mail.com" {
+		t.Errorf("Reading does not continue after the fetched message: %v\n", err)
+	}
+
+	err = mboxReader.SeekMessage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = mboxReader.Read()
+	if err != nil || msg.Offset() != 0 {
+		t.Errorf("Seeking to the first message failed: %v\n", err)
+	}
+	mboxReader.SetFormat(MBOX_FMT_MBOXRD)
+	if err = mboxReader.SeekMessage(0); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Changing the format must drop the index, got:%v\n", err)
+	}
+	mboxReader.SetFormat(MBOX_FMT_AUTO)
+	err = mboxReader.SetIndex(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendFile, err := os.OpenFile(mboxPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendFile.WriteString("From late@mail.com  Thu Nov 19 18:22:17 2020\n\n")
+	appendFile.Close()
+
+	if loaded.IsValid(mboxPath) {
+		t.Error("The index must be out of date after the mailbox has changed")
+	}
+	if err = mboxReader.SeekMessage(1); err == nil {
+		t.Error("Seeking with an out of date index must fail")
+	}
+}
@@ -1,93 +1,205 @@
 package mbox_reader
 
 import (
-	"bufio"
-	"encoding/base64"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/quotedprintable"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Message is a single message read from a mailbox. Only headers are kept in
+// memory, bodies and attachments are read from source when asked for.
 type Message struct {
 	sender      string
 	timestamp   time.Time
+	envelope    string
 	headers     map[string][]string
-	bodies      map[string]Section
-	attachments []Section
-	content     []string
-}
-
-type Section struct {
-	headers   map[string][]string
-	startLine int
-	endLine   int
+	fields      []HeaderField
+	root        *Part
+	bodies      map[string]*Part
+	attachments []*Part
+	source      io.ReaderAt
+	base        int64
+	offset      int64
+	length      int64
+	quoting     MboxFormat
+	warnings    []ParseWarning
+	lenient     bool
+	number      int
+	line        int
 }
 
+// Header is a message header with all of its values in the order they
+// appear in the message. Names are upper-cased and values are unfolded with
+// their encoded words decoded.
 type Header struct {
 	Name   string
 	Values []string
 }
 
+// HeaderField is a single header exactly as it appears in the message: its
+// name as spelled and its raw lines, line breaks and fold points included.
+// Lines longer than a megabyte are cut.
+type HeaderField struct {
+	Name string
+	Raw  string
+}
+
+// Value returns the value of the field unfolded but not decoded.
+func (field HeaderField) Value() string {
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(field.Raw[len(field.Name)+1:])
+	return strings.Trim(value, " \t")
+}
+
+// Lines returns the physical lines of the field without line breaks.
+func (field HeaderField) Lines() []string {
+	lines := strings.SplitAfter(field.Raw, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for ind, line := range lines {
+		lines[ind] = trimLineEnd(line)
+	}
+	return lines
+}
+
+// MessageIface is the read-only view of a message the package promises to keep stable.
 type MessageIface interface {
-	getSender() string
-	getTimestamp() time.Time
-	getBody(string) (string, error)
-	getHeader(string) (Header, bool)
-	getHeaders() []Header
-	getAttachments() []AbstractAttachmentIface
-	getRawContents() string
+	Sender() string
+	Timestamp() time.Time
+	Date() (time.Time, error)
+	Flags() MessageFlags
+	Body(string) (string, error)
+	BodyReader(string) io.Reader
+	RawBody(string) ([]byte, string, error)
+	BodyTypes() []string
+	Offset() int64
+	Length() int64
+	Header(string) (Header, bool)
+	Headers() []Header
+	HeaderFields() []HeaderField
+	HeaderFieldsByName(string) []HeaderField
+	Addresses(string) []Address
+	From() []Address
+	To() []Address
+	Cc() []Address
+	Bcc() []Address
+	ReplyTo() []Address
+	Attachments() []AbstractAttachmentIface
+	Root() *Part
+	Walk(WalkFunc) error
+	EmbeddedMessages() []*Message
+	RawContents() string
+	RawReader() io.Reader
+	Warnings() []ParseWarning
 }
 
-func (message Message) getSender() string {
+var _ MessageIface = Message{}
+
+// Sender returns the envelope sender from the From_ line.
+func (message Message) Sender() string {
 	return message.sender
 }
 
-func (message Message) getTimestamp() time.Time {
+// Timestamp returns the delivery time from the From_ line. From_ lines
+// rarely carry a zone, in which case the time is in UTC.
+func (message Message) Timestamp() time.Time {
 	return message.timestamp
 }
 
-func (message Message) getBody(ctype string) (string, error) {
-	if currSection, ok := message.bodies[ctype]; ok {
-		var rawContent string
-		var trasnEncHeader []string
-		var transEnc string
+// Body returns the body with the given MIME type, such as "text/plain",
+// decoded from its transfer encoding and, for text bodies, converted to
+// UTF-8 from their charset. An empty string is returned when the
+// message has no such body. When several parts have the type, the first one
+// is returned; use Walk to reach the others.
+func (message Message) Body(ctype string) (string, error) {
+	reader := message.BodyReader(ctype)
+	if reader == nil {
+		return "", nil
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
 
-		trasnEncHeader, ok = currSection.headers[string(H_TR_ENC)]
-		if !ok {
-			trasnEncHeader, ok = message.headers[string(H_TR_ENC)]
-		}
-		if ok && len(trasnEncHeader) > 0 {
-			transEnc = trasnEncHeader[0]
-		}
+// BodyReader returns a reader over the body with the given MIME type,
+// decoded as Body does, or nil when there is no such body. The body is read
+// from the mailbox lazily.
+func (message Message) BodyReader(ctype string) io.Reader {
+	part, ok := message.bodies[strings.ToLower(ctype)]
+	if !ok {
+		return nil
+	}
+	return part.TextReader()
+}
 
-		rawContent = strings.Join(message.content[currSection.startLine:currSection.endLine], "")
+// RawBody returns the body with the given MIME type decoded from its
+// transfer encoding but left in its charset, along with the charset the
+// body declares. Nothing is returned when the message has no such body.
+func (message Message) RawBody(ctype string) (content []byte, charsetName string, err error) {
+	part, ok := message.bodies[strings.ToLower(ctype)]
+	if !ok {
+		return nil, "", nil
+	}
+	content, err = part.Contents()
+	return content, part.Charset(), err
+}
 
-		if string(transEnc) == string(TR_ENC_QPRNT) {
-			decodedContent, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(rawContent)))
-			if err != nil {
-				return "", err
-			}
-			return string(decodedContent), nil
+// BodyTypes returns the MIME types of the bodies the message has, sorted.
+func (message Message) BodyTypes() []string {
+	ctypes := make([]string, 0, len(message.bodies))
+	for ctype := range message.bodies {
+		ctypes = append(ctypes, ctype)
+	}
+	sort.Strings(ctypes)
+	return ctypes
+}
 
-		} else if string(transEnc) == string(TR_ENC_B64) {
-			decodedContent, err := base64.StdEncoding.DecodeString(rawContent)
-			if err != nil {
-				return "", err
-			}
-			return string(decodedContent), nil
-		}
+// Offset returns the position of the From_ line of the message in the mailbox.
+// An embedded message has no From_ line and returns where it starts in the
+// enclosing message.
+func (message Message) Offset() int64 {
+	return message.offset
+}
 
-		return rawContent, nil
-	}
-	return "", nil
+// Length returns the size of the message in the mailbox in bytes, From_ line
+// and trailing blank lines included.
+func (message Message) Length() int64 {
+	return message.length
+}
+
+// Header looks up a header by its case-insensitive name.
+func (message Message) Header(name string) (Header, bool) {
+	return lookupHeader(message.headers, name)
+}
+
+// Headers returns all top-level headers of the message in the order their
+// names first appear.
+func (message Message) Headers() []Header {
+	return listHeaders(message.headers, message.fields)
 }
 
-func (message Message) getHeader(name string) (Header, bool) {
-	values, ok := message.headers[name]
+// HeaderFields returns the top-level header fields in their original order.
+func (message Message) HeaderFields() []HeaderField {
+	return message.fields
+}
+
+// HeaderFieldsByName returns the header fields with the given
+// case-insensitive name in their original order.
+func (message Message) HeaderFieldsByName(name string) []HeaderField {
+	return filterHeaderFields(message.fields, name)
+}
+
+func lookupHeader(headerMap map[string][]string, name string) (Header, bool) {
+	name = strings.ToUpper(name)
+	values, ok := headerMap[name]
 	var header Header
 	if ok {
 		header = Header{
@@ -98,67 +210,261 @@ func (message Message) getHeader(name string) (Header, bool) {
 	return header, ok
 }
 
-func (message Message) getHeaders() []Header {
-	var headers = make([]Header, len(message.headers))
-	hind := 0
-	for hkey, hvals := range message.headers {
-		header := Header{
-			Name:   hkey,
-			Values: hvals,
+func listHeaders(headerMap map[string][]string, fields []HeaderField) []Header {
+	headers := make([]Header, 0, len(headerMap))
+	listed := make(map[string]bool, len(headerMap))
+	for _, field := range fields {
+		name := strings.ToUpper(field.Name)
+		if values, ok := headerMap[name]; ok && !listed[name] {
+			headers = append(headers, Header{
+				Name:   name,
+				Values: values,
+			})
+			listed[name] = true
 		}
-		headers[hind] = header
-		hind += 1
 	}
 	return headers
 }
 
-func (message Message) getAttachments() []AbstractAttachmentIface {
-	return nil
+func filterHeaderFields(fields []HeaderField, name string) []HeaderField {
+	matched := make([]HeaderField, 0)
+	for _, field := range fields {
+		if strings.EqualFold(field.Name, name) {
+			matched = append(matched, field)
+		}
+	}
+	return matched
 }
 
-func (message Message) getRawContents() string {
-	return strings.Join(message.content, "\n")
+// Attachments returns the attachments of the message: parts disposed as
+// attachments and non-text parts with a file name or a Content-ID. Inline
+// text parts are bodies. The values are either NamedAttachment or
+// InlineAttachment.
+func (message Message) Attachments() []AbstractAttachmentIface {
+	attachments := make([]AbstractAttachmentIface, len(message.attachments))
+	for ind, part := range message.attachments {
+		attachments[ind] = newAttachment(part)
+	}
+	return attachments
 }
 
-func readMsgContent(reader io.ReadSeeker) (Message, error) {
-	scanner := bufio.NewScanner(reader)
-	var msg = &Message{}
-	var lineStr string
+// Root returns the root of the MIME tree of the message, which carries the
+// message headers.
+func (message Message) Root() *Part {
+	return message.root
+}
 
-	scanner.Scan()
-	lineStr = scanner.Text()
-	msg.content = append(msg.content, lineStr)
+// Walk walks the MIME tree of the message as Part.Walk does.
+func (message Message) Walk(walkFn WalkFunc) error {
+	if message.root == nil {
+		return nil
+	}
+	return message.root.Walk(walkFn)
+}
 
-	for scanner.Scan() {
-		lineStr = scanner.Text()
-		if reachedNewMessage(lineStr) == true {
-			reader.Seek(int64(-len(lineStr)-1), 1)
+// EmbeddedMessages returns the messages embedded as message/rfc822 parts,
+// such as forwarded messages or the originals in bounce reports. Messages
+// embedded into those are reached through their own EmbeddedMessages.
+func (message Message) EmbeddedMessages() []*Message {
+	messages := make([]*Message, 0)
+	message.Walk(func(part *Part, depth int) error {
+		if part.message != nil {
+			messages = append(messages, part.message)
+			return SkipPart
+		}
+		return nil
+	})
+	return messages
+}
+
+// RawContents returns the message as stored in the mailbox, From_ line included.
+func (message Message) RawContents() string {
+	content, _ := ioutil.ReadAll(message.RawReader())
+	return string(content)
+}
+
+// RawReader returns a reader over the message as stored in the mailbox.
+func (message Message) RawReader() io.Reader {
+	return io.NewSectionReader(message.source, message.base, message.length)
+}
+
+func newContentReader(source io.ReaderAt, start int64, length int64, quoting MboxFormat) io.Reader {
+	reader := io.NewSectionReader(source, start, length)
+	if quoting == MBOX_FMT_MBOXCL2 {
+		return reader
+	}
+	return newFromUnquoter(reader, quoting)
+}
+
+// contentEnd returns the offset where the message content ends, that is
+// before the blank line separating it from the next message. Embedded
+// messages have no such separator.
+func (message Message) contentEnd() int64 {
+	if message.envelope == "" {
+		return message.length
+	}
+	tailLength := min(message.length, 4)
+	tail := make([]byte, tailLength)
+	read, _ := message.source.ReadAt(tail, message.base+message.length-tailLength)
+	tailStr := string(tail[:read])
+	if strings.HasSuffix(tailStr, "\r\n\r\n") {
+		return message.length - 2
+	} else if strings.HasSuffix(tailStr, "\n\n") {
+		return message.length - 1
+	}
+	return message.length
+}
+
+// readMsgContent finds the next message, which ends at the following From_
+// line or, depending on the format, after the body length given by the
+// Content-Length header. Only the envelope line and the extent of the
+// message are kept; the message is parsed by parseMessage. It returns io.EOF
+// when the stream holds no more messages.
+func readMsgContent(reader *lineReader, format MboxFormat) (Message, error) {
+	var msg = &Message{quoting: format}
+	var lineStr string
+	var err error
+
+	// blank lines before the first From_ line are not part of any message
+	for {
+		reader.startRecording()
+		msg.offset = reader.offset
+		msg.line = reader.line
+		lineStr, err = reader.readLine(maxHeaderLineLen)
+		if err != nil {
+			return *msg, err
+		}
+		if len(strings.TrimSpace(lineStr)) > 0 {
 			break
 		}
-		msg.content = append(msg.content, lineStr)
 	}
-	if err := scanner.Err(); err != nil {
-		return *msg, err
+	msg.envelope = lineStr
+
+	contentLength := -1
+	for {
+		nextIsFrom, err := reader.nextLineIsFrom()
+		if err != nil {
+			return *msg, err
+		}
+		if nextIsFrom {
+			break
+		}
+		lineStr, err = reader.readLine(maxHeaderLineLen)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return *msg, err
+		}
+		if len(lineStr) == 0 {
+			break
+		}
+		if hname, value, _ := parseHeaderLine(lineStr); hname == H_CT_LENGTH {
+			if length, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && length >= 0 {
+				contentLength = length
+			}
+		}
+	}
+
+	if contentLength >= 0 && (format == MBOX_FMT_AUTO || format == MBOX_FMT_MBOXCL || format == MBOX_FMT_MBOXCL2) {
+		read, err := readContentLengthBody(reader, msg, int64(contentLength), format)
+		if err != nil {
+			return *msg, err
+		}
+		if read {
+			finishMsgContent(reader, msg)
+			return *msg, nil
+		}
+	}
+
+	for {
+		atEOF, err := reader.atEOF()
+		if err != nil {
+			return *msg, err
+		}
+		nextIsFrom, err := reader.nextLineIsFrom()
+		if err != nil {
+			return *msg, err
+		}
+		if atEOF || nextIsFrom {
+			break
+		}
+		err = reader.skipLine()
+		if err != nil && err != io.EOF {
+			return *msg, err
+		}
 	}
+	finishMsgContent(reader, msg)
 	return *msg, nil
 }
 
-func parseMessage(msg *Message) error {
-	id, date, err := parseMessagePrefix(msg.content[0])
+// readContentLengthBody consumes a body of contentLength bytes and the blank
+// lines after it. In MBOX_FMT_AUTO the length is only trusted when the body
+// is followed by blank lines and the next From_ line or the end of the
+// stream; otherwise the reader is rewound and false is returned so the caller
+// can fall back to From_ lines.
+func readContentLengthBody(reader *lineReader, msg *Message, contentLength int64, format MboxFormat) (bool, error) {
+	bodyStart, bodyLine := reader.offset, reader.line
+	consumed, err := reader.discard(contentLength)
 	if err != nil {
+		return false, err
+	}
+
+	if format == MBOX_FMT_AUTO {
+		reachedEnd, err := reader.reachedMessageEnd()
+		if err != nil {
+			return false, err
+		}
+		if consumed != contentLength || !reachedEnd {
+			return false, reader.rewind(bodyStart, bodyLine)
+		}
+		// bodies delimited by Content-Length are not quoted, as in mboxcl2
+		msg.quoting = MBOX_FMT_MBOXCL2
+	}
+
+	for {
+		nextIsBlank, err := reader.nextLineIsBlank()
+		if err != nil {
+			return false, err
+		}
+		if !nextIsBlank {
+			return true, nil
+		}
+		err = reader.skipLine()
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// finishMsgContent records the extent of the message and where it can be
+// read from again.
+func finishMsgContent(reader *lineReader, msg *Message) {
+	msg.length = reader.offset - msg.offset
+	if reader.source != nil {
+		msg.source = reader.source
+		msg.base = msg.offset
+	} else {
+		msg.source = bytes.NewReader(reader.takeRecord())
+		msg.base = 0
+	}
+}
+
+func parseMessage(msg *Message) error {
+	id, date, err := parseMessagePrefix(msg.envelope)
+	if err = msg.tolerate(err, 0); err != nil {
 		return err
 	}
 
 	msg.sender = id
 	msg.timestamp = date
 
-	var linePos int
-	linePos, err = parseMessageHeaders(msg)
+	reader, err := parseMessageHeaders(msg)
 	if err != nil {
 		return err
 	}
 
-	err = parseMessageBody(msg, &linePos)
+	err = parseMessageBody(msg, reader, 0)
 	if err != nil {
 		return err
 	}
@@ -166,17 +472,11 @@ func parseMessage(msg *Message) error {
 }
 
 func parseMessagePrefix(lineStr string) (id string, date time.Time, err error) {
-	const mboxoPrefix = "From "
-	const mboxrdPrefix = ">From "
+	// ">From " is a quoted body line in every mbox flavour, never a separator
+	const prefix = "From "
 
-	var prefix string
-
-	if strings.HasPrefix(lineStr, string(mboxoPrefix)) {
-		prefix = string(mboxoPrefix)
-	} else if strings.HasPrefix(lineStr, string(mboxrdPrefix)) {
-		prefix = string(mboxrdPrefix)
-	} else {
-		err = errors.New("Not a message start line.")
+	if !strings.HasPrefix(lineStr, prefix) {
+		err = ErrNotMessageStart
 		return
 	}
 
@@ -184,194 +484,306 @@ func parseMessagePrefix(lineStr string) (id string, date time.Time, err error) {
 
 	idx := strings.Index(lineStr, " ")
 	if idx == -1 {
-		err = errors.New("A white space after message id is missing.")
+		err = ErrMalformedFromLine
 		return
 	}
 	id = lineStr[0:idx]
 	lineStr = strings.TrimLeft(lineStr[idx+1:], " ")
 
-	date, err = time.Parse(HEAD_TIMESTAMP_FMT, lineStr)
+	date, err = parseFromLineDate(lineStr)
 	if err != nil {
-		err = fmt.Errorf("invalid date %q:%q", err.Error(), lineStr)
+		err = fmt.Errorf("invalid date %q: %w", lineStr, err)
 		return
 	}
 	return
 }
 
-func parseMessageHeaders(msg *Message) (int, error) {
-	var linePos int
-	linePos = 1
-	headers, err := parseHeaders(msg, &linePos)
+// parseMessageHeaders parses the headers following the From_ line and
+// returns a reader positioned at the beginning of the body.
+func parseMessageHeaders(msg *Message) (*lineReader, error) {
+	reader := newSectionLineReader(msg.source, msg.base, msg.length)
+	err := reader.skipLine()
+	if err != nil {
+		return nil, err
+	}
+	headerStart := reader.offset
+	headers, fields, err := parseHeaders(reader)
 	msg.headers = headers
+	msg.fields = fields
 	if err != nil {
-		return 1, err
+		return nil, err
 	}
-	return linePos, nil
+	msg.root = newPart(msg, headers, fields, headerStart, reader.offset, CT_DEFAULT)
+	return reader, nil
 }
 
-func parseMessageBody(msg *Message, linePos *int) (err error) {
-	isMultipart, boundary, err := messageIsMultipart(msg)
+func parseMessageBody(msg *Message, reader *lineReader, depth int) (err error) {
+	if msg.root.IsMultipart() && msg.root.Param("boundary") == "" && !msg.lenient {
+		// in lenient mode it is reported while parsing the parts
+		return msg.tolerate(ErrEmptyBoundary, msg.root.headerStart)
+	}
+	_, err = parsePartBody(msg, msg.root, nil, reader, depth)
 	if err != nil {
 		return err
 	}
-	if isMultipart {
-		boundary = "--" + boundary
-		err := parseMultipartMessageBody(msg, boundary, linePos)
-		if err != nil {
-			return err
-		}
-	} else {
-		err := parseSimpleMessageBody(msg, linePos)
-		if err != nil {
-			return err
-		}
-	}
+	collectMessageParts(msg)
 	return nil
 }
 
-func parseSimpleMessageBody(msg *Message, linePos *int) (err error) {
-	var section Section
-	section.startLine = *linePos
-	newPos := len(msg.content) - 1
-	*linePos = newPos
-	section.endLine = *linePos
-	msg.bodies = make(map[string]Section)
-	msg.bodies[string(getMimeTypeFromCType(msg.headers[string(H_CT_TYPE)][0]))] = section
-	return nil
+// boundaryHit tells which boundary ended a part. level indexes the boundaries
+// of the enclosing multiparts, outermost first, and is -1 when the end of the
+// message was reached instead.
+type boundaryHit struct {
+	level int
+	last  bool
+	end   int64
 }
 
-func parseMultipartMessageBody(msg *Message, boundary string, linePos *int) (err error) {
-	for !strings.HasPrefix(msg.content[*linePos], boundary) {
-		*linePos += 1
-	}
-	msg.bodies = make(map[string]Section)
-	msg.attachments = make([]Section, 0)
-	stopReading := false
-
-	for stopReading == false {
-		stopReading, err := parseSection(msg, boundary, linePos)
+// parsePartBody reads the content of a part up to the boundary of its parent,
+// or up to the end of the message when there are no boundaries. The parts of
+// a multipart are parsed recursively. In lenient mode the boundary of any
+// enclosing multipart also ends the part, so a missing closing boundary does
+// not swallow the rest of the message.
+func parsePartBody(msg *Message, part *Part, boundaries []string,
+	reader *lineReader, depth int) (hit boundaryHit, err error) {
+
+	var ended *boundaryHit
+	if part.IsMultipart() && depth < maxPartDepth {
+		ended, err = parseMultipartChildren(msg, part, boundaries, reader, depth)
 		if err != nil {
-			return err
+			return boundaryHit{level: -1, last: true}, err
 		}
-		if stopReading {
-			break
+	}
+	switch {
+	case len(boundaries) == 0:
+		part.end = max(msg.contentEnd(), part.start)
+		hit = boundaryHit{level: -1, last: true, end: part.end}
+	case ended != nil:
+		// the boundary belongs to an enclosing multipart
+		hit = *ended
+		part.end = max(hit.end, part.start)
+	default:
+		first := len(boundaries) - 1
+		if msg.lenient {
+			first = 0
+		}
+		hit, err = readUntilBoundary(reader, boundaries, first, part.start)
+		part.end = hit.end
+		if err = msg.tolerate(err, hit.end); err != nil {
+			return hit, err
 		}
 	}
-	return nil
+	if part.contentType == CT_MSG_RFC822 && depth < maxPartDepth {
+		// an embedded message that can not be parsed stays an opaque part
+		embedded, err := parseEmbeddedMessage(part, depth+1)
+		if err == nil {
+			part.message = embedded
+			part.children = []*Part{embedded.root}
+		}
+	}
+	return hit, nil
 }
 
-func parseSection(msg *Message, boundary string, linePos *int) (lastSection bool, err error) {
-	*linePos += 1
-	sectionHeaders, err := parseHeaders(msg, linePos)
-	if err != nil {
-		return
+// parseEmbeddedMessage parses the content of a message/rfc822 part as a
+// message of its own, which has no From_ line and starts at the offset of
+// the part. Content in base64 or quoted-printable is decoded into memory.
+func parseEmbeddedMessage(part *Part, depth int) (*Message, error) {
+	msg := &Message{
+		source:  part.source,
+		base:    part.base + part.start,
+		offset:  part.start,
+		length:  part.end - part.start,
+		quoting: part.quoting,
 	}
-	if _, ok := sectionHeaders[string(H_CT_DISP)]; !ok {
-		lastSection, err := parseMainContentSection(msg, boundary, sectionHeaders, linePos)
-		return lastSection, err
-	} else {
-		lastSection, err := parseAttachmentSection(msg, boundary, sectionHeaders, linePos)
-		return lastSection, err
+	if transEnc := part.transferEncoding(); transEnc == TR_ENC_B64 || transEnc == TR_ENC_QPRNT {
+		content, err := part.Contents()
+		if err != nil {
+			return nil, err
+		}
+		msg.source = bytes.NewReader(content)
+		msg.base = 0
+		msg.length = int64(len(content))
+		msg.quoting = MBOX_FMT_MBOXCL2
 	}
-}
 
-func parseMainContentSection(msg *Message, boundary string,
-	sectionHeaders map[string][]string, linePos *int) (lastSection bool, err error) {
-
-	ctype, ok := sectionHeaders[string(H_CT_TYPE)]
-	if !ok || ctype[0] == "" {
-		err = errors.New("The section does not have a Content-Type header")
-		return
+	reader := newSectionLineReader(msg.source, msg.base, msg.length)
+	headers, fields, err := parseHeaders(reader)
+	if err != nil {
+		return nil, err
 	}
-	if strings.HasPrefix(ctype[0], string(CT_MP_ALTER)) {
-		lastSection, err := parseAlternativeSection(msg, boundary, ctype[0], linePos)
-		return lastSection, err
-	} else {
-		lastSection, err := parseTextSection(msg, boundary, ctype[0], sectionHeaders, linePos)
-		return lastSection, err
+	msg.headers = headers
+	msg.fields = fields
+	msg.root = newPart(msg, headers, fields, 0, reader.offset, CT_DEFAULT)
+	err = parseMessageBody(msg, reader, depth)
+	if err != nil {
+		return nil, err
 	}
+	return msg, nil
 }
 
-func parseTextSection(msg *Message, boundary string, ctype string,
-	sectionHeaders map[string][]string, linePos *int) (lastSection bool, err error) {
-
-	*linePos += 1
-	var section Section
-	section.startLine = *linePos
-	section.headers = sectionHeaders
-
-	for !strings.HasPrefix(msg.content[*linePos], boundary) {
-		*linePos += 1
+// parseMultipartChildren skips the preamble of a multipart and parses its
+// parts up to the closing boundary. When the parts are ended by the boundary
+// of an enclosing multipart or by the end of the message, which only happens
+// in lenient mode, it returns where.
+func parseMultipartChildren(msg *Message, part *Part, boundaries []string,
+	reader *lineReader, depth int) (*boundaryHit, error) {
+
+	boundary := part.Param("boundary")
+	if boundary == "" {
+		// the part is kept as a single one
+		return nil, msg.tolerate(ErrBoundaryMissing, part.start)
+	}
+	boundaries = append(boundaries[:len(boundaries):len(boundaries)], "--"+boundary)
+	level := len(boundaries) - 1
+	first := level
+	if msg.lenient {
+		first = 0
 	}
-	section.endLine = *linePos
-	msg.bodies[string(getMimeTypeFromCType(ctype))] = section
 
-	lastSection = msg.content[*linePos] == boundary+"--"
-	return lastSection, err
-}
+	hit, err := readUntilBoundary(reader, boundaries, first, part.start)
+	if hit.level != level && (err == nil || errors.Is(err, ErrClosingBoundaryMissing)) {
+		err = ErrBoundaryMissing
+	}
+	if err = msg.tolerate(err, hit.end); err != nil {
+		return nil, err
+	}
+	if hit.level != level {
+		return &hit, nil
+	}
+	if hit.last {
+		return nil, nil
+	}
 
-func parseAlternativeSection(msg *Message, boundary string, ctype string, linePos *int) (lastSection bool, err error) {
-	alterBoundary := getBoundaryFromCType(ctype)
-	// section is corrupted, just read raw content
-	if alterBoundary == "" {
-		for !strings.HasPrefix(msg.content[*linePos], boundary) {
-			*linePos += 1
+	defaultCType := CT_DEFAULT
+	if part.contentType == CT_MP_DIGEST {
+		defaultCType = CT_MSG_RFC822
+	}
+	for {
+		headerStart := reader.offset
+		headers, fields, err := parseHeaders(reader)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		err := parseMultipartMessageBody(msg, alterBoundary, linePos)
+		child := newPart(msg, headers, fields, headerStart, reader.offset, defaultCType)
+		part.children = append(part.children, child)
+		hit, err := parsePartBody(msg, child, boundaries, reader, depth+1)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		for !strings.HasPrefix(msg.content[*linePos], boundary) {
-			*linePos += 1
+		if hit.level != level {
+			if hit.level >= 0 {
+				msg.tolerate(ErrClosingBoundaryMissing, hit.end)
+			}
+			return &hit, nil
+		}
+		if hit.last {
+			return nil, nil
 		}
 	}
+}
 
-	lastSection = msg.content[*linePos] == boundary+"--"
-	return lastSection, err
+// collectMessageParts sorts the leaves of the MIME tree into bodies, keyed by
+// their type, and attachments. The first part of a type is the body of that
+// type. A message that is not multipart is a body as a whole, and an embedded
+// message is a single part whose own parts belong to that message.
+func collectMessageParts(msg *Message) {
+	msg.bodies = make(map[string]*Part)
+	msg.attachments = make([]*Part, 0)
+	msg.root.Walk(func(part *Part, depth int) error {
+		if len(part.children) > 0 && part.IsMultipart() {
+			return nil
+		}
+		if depth > 0 && sectionIsAttachment(part) {
+			msg.attachments = append(msg.attachments, part)
+		} else if _, ok := msg.bodies[part.contentType]; !ok {
+			msg.bodies[part.contentType] = part
+		}
+		return SkipPart
+	})
 }
 
-func parseAttachmentSection(msg *Message, boundary string,
-	sectionHeaders map[string][]string, linePos *int) (lastSection bool, err error) {
-	var section Section
-	section.startLine = *linePos
-	section.headers = sectionHeaders
-	for !strings.HasPrefix(msg.content[*linePos], boundary) {
-		*linePos += 1
+// sectionIsAttachment reports whether a section is disposed as an attachment
+// or is a non-text section with a file name, or with a Content-ID as inline
+// images have. Inline text sections are bodies.
+func sectionIsAttachment(part *Part) bool {
+	if part.disposition() == CD_ATTACHMENT {
+		return true
+	}
+	if strings.HasPrefix(part.contentType, "text/") {
+		return false
 	}
-	section.endLine = *linePos
-	msg.attachments = append(msg.attachments, section)
+	contentId, ok := part.headers[string(H_CT_ID)]
+	return part.getFileName() != "" || ok && len(contentId) > 0
+}
 
-	lastSection = msg.content[*linePos] == boundary+"--"
-	return lastSection, err
+// readUntilBoundary consumes lines up to and including the next line starting
+// with one of boundaries[first:], checking the innermost boundary first. It
+// returns where the content before the boundary ends, not counting the line
+// break that belongs to the boundary, which boundary it was and whether it
+// was the closing one.
+func readUntilBoundary(reader *lineReader, boundaries []string, first int, start int64) (boundaryHit, error) {
+	var prevEnding int
+	for {
+		lineStart := reader.offset
+		lineStr, err := reader.readLine(maxBoundaryLineLen)
+		if err == io.EOF {
+			return boundaryHit{level: -1, last: true, end: lineStart}, ErrClosingBoundaryMissing
+		}
+		if err != nil {
+			return boundaryHit{level: -1, last: true, end: lineStart}, err
+		}
+		for level := len(boundaries) - 1; level >= first; level-- {
+			if strings.HasPrefix(lineStr, boundaries[level]) {
+				return boundaryHit{
+					level: level,
+					last:  strings.TrimRight(lineStr, " \t") == boundaries[level]+"--",
+					end:   max(lineStart-int64(prevEnding), start),
+				}, nil
+			}
+		}
+		prevEnding = reader.lastEnding
+	}
 }
 
-func parseHeaders(msg *Message, linePos *int) (map[string][]string, error) {
+// parseHeaders reads headers up to the blank line ending them. Folded lines
+// are unfolded before encoded words are decoded, except in Content-Type and
+// Content-Disposition, whose parameters are decoded when they are looked up.
+// The fields are also returned as they appear.
+func parseHeaders(reader *lineReader) (map[string][]string, []HeaderField, error) {
 	var currHeaderName string
 	var lastHeaderValueIdx = 0
 	var headers = make(map[string][]string)
+	var fields = make([]HeaderField, 0)
 
-	for len(msg.content[*linePos]) > 0 {
-		hname, value, err := parseHeaderLine(msg.content[*linePos])
-		if err != nil {
-			return nil, err
+	for {
+		lineStr, err := reader.readLine(maxHeaderLineLen)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if err == io.EOF || len(lineStr) == 0 {
+			break
 		}
+		rawLine := lineStr + "\r\n"[2-reader.lastEnding:]
 
+		hname, value, nameLen := splitHeaderLine(lineStr)
 		if hname != "" {
-			if headers[hname] == nil {
-				headers[hname] = make([]string, 0)
-			}
 			headers[hname] = append(headers[hname], value)
 			lastHeaderValueIdx = len(headers[hname]) - 1
 			currHeaderName = hname
-		} else {
-			lastValue := headers[currHeaderName][lastHeaderValueIdx]
-			lastValue += value
-			headers[currHeaderName][lastHeaderValueIdx] = lastValue
+			fields = append(fields, HeaderField{Name: lineStr[:nameLen], Raw: rawLine})
+		} else if currHeaderName != "" {
+			headers[currHeaderName][lastHeaderValueIdx] += value
+			fields[len(fields)-1].Raw += rawLine
 		}
-
-		*linePos += 1
 	}
 
-	return headers, nil
+	for hname, values := range headers {
+		if hname == H_CT_TYPE || hname == H_CT_DISP {
+			continue
+		}
+		for ind, value := range values {
+			values[ind] = decodeMimeEncoded(value)
+		}
+	}
+	return headers, fields, nil
 }
@@ -1,6 +1,8 @@
 package mbox_reader
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,10 +15,11 @@ import (
 
 func TestParseMessagePrefix(t *testing.T) {
 	type ParseMessagePrefixTestCase struct {
-		Line     string `json:"line"`
-		Id       string `json:"id"`
-		DateTime string `json:"datetime"`
-		Error    string `json:"error"`
+		Line        string `json:"line"`
+		Id          string `json:"id"`
+		DateTime    string `json:"datetime"`
+		UnknownZone bool   `json:"unknown-zone"`
+		Error       string `json:"error"`
 	}
 	testTable := make([]ParseMessagePrefixTestCase, 4)
 	data, err := ioutil.ReadFile("testcases/parse_message_prefix_cases.json")
@@ -28,7 +31,63 @@ func TestParseMessagePrefix(t *testing.T) {
 	for _, tcase := range testTable {
 		t.Run(string(tcase.Line), func(t *testing.T) {
 			parsedId, parsedTime, parsedErr := parseMessagePrefix(tcase.Line)
-			fmt.Printf("id: %s time: %s err: %s\n", parsedId, parsedTime, parsedErr)
+			if tcase.Error != "" {
+				if parsedErr == nil || !strings.HasPrefix(parsedErr.Error(), tcase.Error) {
+					t.Errorf("Error is not correct. Want:%s, got:%v\n", tcase.Error, parsedErr)
+				}
+				return
+			}
+			if parsedErr != nil {
+				t.Fatal(parsedErr)
+			}
+			if parsedId != tcase.Id {
+				t.Errorf("Id is not correct. Want:%s, got:%s\n", tcase.Id, parsedId)
+			}
+			if parsedTime.UTC().Format("2006-01-02 15:04:05") != tcase.DateTime {
+				t.Errorf("Time is not correct. Want:%s, got:%s\n", tcase.DateTime, parsedTime.UTC())
+			}
+			if (parsedTime.Location() == unknownZone) != tcase.UnknownZone {
+				t.Errorf("Zone is not correct. Want unknown:%t, got:%s\n", tcase.UnknownZone, parsedTime.Location())
+			}
+		})
+	}
+}
+
+func TestParseDateHeader(t *testing.T) {
+	type ParseDateHeaderTestCase struct {
+		Value       string `json:"value"`
+		DateTime    string `json:"datetime"`
+		UnknownZone bool   `json:"unknown-zone"`
+		Error       string `json:"error"`
+	}
+	testTable := make([]ParseDateHeaderTestCase, 0)
+	data, err := ioutil.ReadFile("testcases/parse_date_header_cases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			date, err := parseDateHeader(tcase.Value)
+			if tcase.Error != "" {
+				if err == nil || err.Error() != tcase.Error {
+					t.Errorf("Error is not correct. Want:%s, got:%v\n", tcase.Error, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if date.Format(time.RFC3339) != tcase.DateTime {
+				t.Errorf("Date is not correct. Want:%s, got:%s\n", tcase.DateTime, date.Format(time.RFC3339))
+			}
+			if (date.Location() == unknownZone) != tcase.UnknownZone {
+				t.Errorf("Zone is not correct. Want unknown:%t, got:%s\n", tcase.UnknownZone, date.Location())
+			}
 		})
 	}
 }
@@ -51,7 +110,7 @@ func TestParseMessageHeaders(t *testing.T) {
 			if err != nil {
 				fmt.Println(err)
 			}
-			msg, err := readMsgContent(openedFile)
+			msg, err := readMsgContent(newLineReader(openedFile), MBOX_FMT_AUTO)
 			if err != nil {
 				fmt.Println(err)
 			}
@@ -105,7 +164,7 @@ func TestParseMessage(t *testing.T) {
 				fmt.Println(err)
 			}
 
-			msg, err := readMsgContent(openedFile)
+			msg, err := readMsgContent(newLineReader(openedFile), MBOX_FMT_AUTO)
 			if err != nil {
 				fmt.Println(err)
 			}
@@ -116,17 +175,17 @@ func TestParseMessage(t *testing.T) {
 			}
 			// fmt.Printf("CONTENT: %s\n", strings.Join(msg.content, "\n"))
 
-			msgSender := string(msg.getSender())
+			msgSender := string(msg.Sender())
 			if msgSender != tcase.Sender {
 				t.Errorf("Sender is not correct. Want:%s, got:%s\n", tcase.Sender, msgSender)
 			}
-			msgTimestamp := msg.getTimestamp().Format(time.RFC3339)
+			msgTimestamp := msg.Timestamp().Format(time.RFC3339)
 			if msgTimestamp != tcase.Timestamp {
 				t.Errorf("Timestamp is not correct. Want:%s, got:%s\n", tcase.Timestamp, msgTimestamp)
 			}
 
 			for hkey, hval := range tcase.Headers {
-				msgHeader, ok := msg.getHeader(strings.ToUpper(hkey))
+				msgHeader, ok := msg.Header(strings.ToUpper(hkey))
 				if !ok {
 					t.Errorf("Can not find the header %s\n", strings.ToUpper(hkey))
 				}
@@ -142,7 +201,7 @@ func TestParseMessage(t *testing.T) {
 			}
 
 			for bkey, tbcontent := range tcase.Bodies {
-				bcontent, err := msg.getBody(bkey)
+				bcontent, err := msg.Body(bkey)
 				if err != nil {
 					t.Errorf("Error while getting body section %s\n", strings.ToLower(bkey))
 				}
@@ -151,6 +210,347 @@ func TestParseMessage(t *testing.T) {
 					t.Errorf("%s body content is not correct.\nWant:\n%s\ngot:\n%s\n", strings.ToLower(bkey), tbcontent, strBContent)
 				}
 			}
+
+			msgAttachments := msg.Attachments()
+			if len(msgAttachments) != len(tcase.Attachments) {
+				t.Errorf("Attachments count is not correct. Want:%d, got:%d\n", len(tcase.Attachments), len(msgAttachments))
+			}
+			for aind, tattachment := range tcase.Attachments {
+				if aind >= len(msgAttachments) {
+					break
+				}
+				want, err := ioutil.ReadFile("testcases/distinct-messages/" + tattachment.Content)
+				if err != nil {
+					t.Error(err)
+				}
+				got, err := msgAttachments[aind].Contents(true)
+				if err != nil {
+					t.Errorf("Error while decoding attachment %d: %s\n", aind, err)
+				}
+				if got != string(want) {
+					t.Errorf("Attachment %d content is not correct. Want %d bytes, got %d bytes\n", aind, len(want), len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestParseMessageLongLines(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	var stream bytes.Buffer
+	stream.WriteString("From sender@mail.com  Thu Nov 19 16:22:17 2020\n")
+	stream.WriteString("Subject: long lines\n")
+	stream.WriteString("Content-Type: multipart/mixed; boundary=\"b1\"\n\n")
+	stream.WriteString("--b1\nContent-Type: text/plain\n\n" + strings.Repeat("x", 200*1024) + "\n")
+	stream.WriteString("--b1\nContent-Type: application/octet-stream; name=\"data.bin\"\n")
+	stream.WriteString("Content-Transfer-Encoding: base64\n\n" + encoded + "\n--b1--\n")
+
+	msg, err := readMsgContent(newLineReader(&stream), MBOX_FMT_AUTO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parseMessage(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := msg.Body(CT_TXT_PLAIN)
+	if err != nil || len(body) != 200*1024 {
+		t.Errorf("The long body line is not read. Want %d bytes, got %d, %v\n", 200*1024, len(body), err)
+	}
+	attachments := msg.Attachments()
+	if len(attachments) != 1 {
+		t.Fatalf("Attachments count is not correct. Want:1, got:%d\n", len(attachments))
+	}
+	content, err := ioutil.ReadAll(attachments[0].ContentReader())
+	if err != nil || !bytes.Equal(content, payload) {
+		t.Errorf("The attachment is not decoded. Want %d bytes, got %d, %v\n", len(payload), len(content), err)
+	}
+}
+
+func TestParseMimeTree(t *testing.T) {
+	type PartTestItem struct {
+		Depth       int    `json:"depth"`
+		ContentType string `json:"content-type"`
+		Content     string `json:"content"`
+	}
+	type ParseMimeTreeTestCase struct {
+		MessageFile string            `json:"message-file"`
+		Parts       []PartTestItem    `json:"parts"`
+		Bodies      map[string]string `json:"bodies"`
+		Attachments int               `json:"attachments"`
+	}
+	testTable := make([]ParseMimeTreeTestCase, 0)
+	data, err := ioutil.ReadFile("testcases/parse_mime_tree_cases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			openedFile, err := os.Open("testcases/distinct-messages/" + tcase.MessageFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer openedFile.Close()
+
+			msg, err := readMsgContent(newLineReader(openedFile), MBOX_FMT_AUTO)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = parseMessage(&msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var parts []PartTestItem
+			err = msg.Walk(func(part *Part, depth int) error {
+				content, err := part.Contents()
+				if err != nil {
+					return err
+				}
+				parts = append(parts, PartTestItem{Depth: depth, ContentType: part.ContentType(), Content: string(content)})
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != len(tcase.Parts) {
+				t.Fatalf("Parts count is not correct. Want:%d, got:%d\n", len(tcase.Parts), len(parts))
+			}
+			for pind, tpart := range tcase.Parts {
+				if parts[pind].Depth != tpart.Depth || parts[pind].ContentType != tpart.ContentType {
+					t.Errorf("Part %d is not correct. Want:%d %s, got:%d %s\n", pind,
+						tpart.Depth, tpart.ContentType, parts[pind].Depth, parts[pind].ContentType)
+				}
+				if tpart.Content != "" && parts[pind].Content != tpart.Content {
+					t.Errorf("Part %d content is not correct.\nWant:\n%s\ngot:\n%s\n", pind, tpart.Content, parts[pind].Content)
+				}
+			}
+
+			for bkey, tbcontent := range tcase.Bodies {
+				bcontent, err := msg.Body(bkey)
+				if err != nil {
+					t.Error(err)
+				}
+				if bcontent != tbcontent {
+					t.Errorf("%s body content is not correct.\nWant:\n%s\ngot:\n%s\n", bkey, tbcontent, bcontent)
+				}
+			}
+			if len(msg.Attachments()) != tcase.Attachments {
+				t.Errorf("Attachments count is not correct. Want:%d, got:%d\n", tcase.Attachments, len(msg.Attachments()))
+			}
+
+			var visited int
+			msg.Walk(func(part *Part, depth int) error {
+				visited++
+				if depth > 0 {
+					return SkipPart
+				}
+				return nil
+			})
+			if visited != len(msg.Root().Children())+1 {
+				t.Errorf("SkipPart does not skip children. Visited %d parts\n", visited)
+			}
+		})
+	}
+}
+
+func TestParseEmbeddedMessages(t *testing.T) {
+	type EmbeddedMessageTestItem struct {
+		Subject         string                    `json:"subject"`
+		Bodies          map[string]string         `json:"bodies"`
+		Attachments     int                       `json:"attachments"`
+		AttachmentTypes []string                  `json:"attachment-types"`
+		Embedded        []EmbeddedMessageTestItem `json:"embedded"`
+	}
+	type ParseEmbeddedMessagesTestCase struct {
+		MessageFile string                  `json:"message-file"`
+		Message     EmbeddedMessageTestItem `json:"message"`
+	}
+	testTable := make([]ParseEmbeddedMessagesTestCase, 0)
+	data, err := ioutil.ReadFile("testcases/parse_embedded_messages_cases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var checkMessage func(t *testing.T, path string, msg *Message, want EmbeddedMessageTestItem)
+	checkMessage = func(t *testing.T, path string, msg *Message, want EmbeddedMessageTestItem) {
+		if want.Subject != "" {
+			subject, _ := msg.Header(H_SUBJECT)
+			if len(subject.Values) == 0 || subject.Values[0] != want.Subject {
+				t.Errorf("%s: subject is not correct. Want:%s, got:%v\n", path, want.Subject, subject.Values)
+			}
+		}
+		for bkey, tbcontent := range want.Bodies {
+			bcontent, err := msg.Body(bkey)
+			if err != nil {
+				t.Error(err)
+			}
+			if bcontent != tbcontent {
+				t.Errorf("%s: %s body content is not correct.\nWant:\n%s\ngot:\n%s\n", path, bkey, tbcontent, bcontent)
+			}
+		}
+		if len(msg.Attachments()) != want.Attachments {
+			t.Errorf("%s: attachments count is not correct. Want:%d, got:%d\n", path, want.Attachments, len(msg.Attachments()))
+		}
+		for aind, ctype := range want.AttachmentTypes {
+			if aind < len(msg.Attachments()) && msg.Attachments()[aind].MimeType() != ctype {
+				t.Errorf("%s: attachment %d type is not correct. Want:%s, got:%s\n", path, aind, ctype, msg.Attachments()[aind].MimeType())
+			}
+		}
+		embedded := msg.EmbeddedMessages()
+		if len(embedded) != len(want.Embedded) {
+			t.Errorf("%s: embedded messages count is not correct. Want:%d, got:%d\n", path, len(want.Embedded), len(embedded))
+			return
+		}
+		for eind, wantEmbedded := range want.Embedded {
+			checkMessage(t, fmt.Sprintf("%s/%d", path, eind), embedded[eind], wantEmbedded)
+		}
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			openedFile, err := os.Open("testcases/distinct-messages/" + tcase.MessageFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer openedFile.Close()
+
+			msg, err := readMsgContent(newLineReader(openedFile), MBOX_FMT_AUTO)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = parseMessage(&msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMessage(t, tcase.MessageFile, &msg, tcase.Message)
+		})
+	}
+}
+
+func TestBodyCharsets(t *testing.T) {
+	type BodyCharsetTestCase struct {
+		BodyType string `json:"body-type"`
+		Body     string `json:"body"`
+		Charset  string `json:"charset"`
+	}
+	testTable := make([]BodyCharsetTestCase, 0)
+	data, err := ioutil.ReadFile("testcases/body_charset_cases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mboxReader, err := NewMboxReader("testcases/distinct-messages/charsets.mbox", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			msg, err := mboxReader.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := msg.Body(tcase.BodyType)
+			if err != nil {
+				t.Error(err)
+			}
+			if body != tcase.Body {
+				t.Errorf("Body is not correct. Want:%q, got:%q\n", tcase.Body, body)
+			}
+			_, charsetName, err := msg.RawBody(tcase.BodyType)
+			if err != nil {
+				t.Error(err)
+			}
+			if charsetName != tcase.Charset {
+				t.Errorf("Charset is not correct. Want:%q, got:%q\n", tcase.Charset, charsetName)
+			}
+		})
+	}
+}
+
+func TestHeaderFields(t *testing.T) {
+	type HeaderFieldTestItem struct {
+		Name  string   `json:"name"`
+		Raw   string   `json:"raw"`
+		Value string   `json:"value"`
+		Lines []string `json:"lines"`
+	}
+	type HeaderFieldsTestCase struct {
+		MessageFile string                `json:"message-file"`
+		Fields      []HeaderFieldTestItem `json:"fields"`
+		Headers     []string              `json:"headers"`
+		Lookup      map[string]int        `json:"lookup"`
+	}
+	testTable := make([]HeaderFieldsTestCase, 0)
+	data, err := ioutil.ReadFile("testcases/header_fields_cases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			openedFile, err := os.Open("testcases/distinct-messages/" + tcase.MessageFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer openedFile.Close()
+			msg, err := readMsgContent(newLineReader(openedFile), MBOX_FMT_AUTO)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = parseMessageHeaders(&msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fields := msg.HeaderFields()
+			if tcase.Fields != nil && len(fields) != len(tcase.Fields) {
+				t.Fatalf("Fields count is not correct. Want:%d, got:%d\n", len(tcase.Fields), len(fields))
+			}
+			for find, tfield := range tcase.Fields {
+				field := fields[find]
+				if field.Name != tfield.Name || field.Raw != tfield.Raw {
+					t.Errorf("Field %d is not correct. Want:%q %q, got:%q %q\n", find, tfield.Name, tfield.Raw, field.Name, field.Raw)
+				}
+				if field.Value() != tfield.Value {
+					t.Errorf("Field %d value is not correct. Want:%q, got:%q\n", find, tfield.Value, field.Value())
+				}
+				if !reflect.DeepEqual(field.Lines(), tfield.Lines) {
+					t.Errorf("Field %d lines are not correct. Want:%q, got:%q\n", find, tfield.Lines, field.Lines())
+				}
+			}
+
+			var names []string
+			for _, header := range msg.Headers() {
+				names = append(names, header.Name)
+			}
+			if !reflect.DeepEqual(names, tcase.Headers) {
+				t.Errorf("Headers order is not correct. Want:%v, got:%v\n", tcase.Headers, names)
+			}
+			for name, count := range tcase.Lookup {
+				if found := len(msg.HeaderFieldsByName(name)); found != count {
+					t.Errorf("Lookup of %s is not correct. Want:%d, got:%d\n", name, count, found)
+				}
+			}
 		})
 	}
 }
@@ -0,0 +1,207 @@
+package mbox_reader
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// maxPartDepth limits how deep multiparts are parsed. A multipart nested
+// deeper is kept as a single part with its content unparsed.
+const maxPartDepth = 64
+
+// SkipPart can be returned by a WalkFunc to skip the children of a part.
+var SkipPart = errors.New("skip this part")
+
+// WalkFunc is called by Walk for every part of a MIME tree. depth is 0 for
+// the part Walk was called on.
+type WalkFunc func(part *Part, depth int) error
+
+// Part is a node of the MIME tree of a message. The root part carries the
+// message headers; multiparts of any subtype have their parts as children,
+// and a message/rfc822 part has the root of the embedded message as its only
+// child. Offsets are relative to the beginning of the message.
+type Part struct {
+	headers     map[string][]string
+	fields      []HeaderField
+	contentType string
+	params      map[string]string
+	children    []*Part
+	message     *Message
+	headerStart int64
+	start       int64
+	end         int64
+	source      io.ReaderAt
+	base        int64
+	quoting     MboxFormat
+}
+
+// newPart creates a part with the given headers. A part without a valid
+// Content-Type gets defaultCType, which depends on its parent.
+func newPart(msg *Message, headers map[string][]string, fields []HeaderField,
+	headerStart int64, start int64, defaultCType string) *Part {
+	part := &Part{
+		headers:     headers,
+		fields:      fields,
+		params:      make(map[string]string),
+		headerStart: headerStart,
+		start:       start,
+		end:         start,
+		source:      msg.source,
+		base:        msg.base,
+		quoting:     msg.quoting,
+	}
+	ctype := defaultCType
+	if values, ok := headers[string(H_CT_TYPE)]; ok && len(values) > 0 &&
+		strings.Contains(getMimeTypeFromCType(values[0]), "/") {
+		ctype = values[0]
+	}
+	part.contentType = strings.ToLower(getMimeTypeFromCType(ctype))
+	part.params = getParamsFromHeader(ctype)
+	return part
+}
+
+func (part *Part) getFileName() string {
+	return getAttachmentFileName(part.headers)
+}
+
+// disposition returns the lower-cased Content-Disposition type, if any.
+func (part *Part) disposition() string {
+	values, ok := part.headers[string(H_CT_DISP)]
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(strings.Split(values[0], ";")[0], " \t"))
+}
+
+// ContentType returns the lower-cased MIME type from the Content-Type header
+// without parameters. A part without a valid Content-Type is text/plain in
+// us-ascii, or message/rfc822 when it is a part of a multipart/digest.
+func (part *Part) ContentType() string {
+	return part.contentType
+}
+
+// Param returns a Content-Type parameter by its case-insensitive name.
+func (part *Part) Param(name string) string {
+	return part.params[strings.ToLower(name)]
+}
+
+// Params returns all Content-Type parameters keyed by their lower-cased names.
+func (part *Part) Params() map[string]string {
+	params := make(map[string]string, len(part.params))
+	for name, value := range part.params {
+		params[name] = value
+	}
+	return params
+}
+
+// Header looks up a header of the part by its case-insensitive name.
+func (part *Part) Header(name string) (Header, bool) {
+	return lookupHeader(part.headers, name)
+}
+
+// Headers returns all headers of the part in the order their names first appear.
+func (part *Part) Headers() []Header {
+	return listHeaders(part.headers, part.fields)
+}
+
+// HeaderFields returns the header fields of the part in their original order.
+func (part *Part) HeaderFields() []HeaderField {
+	return part.fields
+}
+
+// IsMultipart reports whether the part has a multipart content type.
+func (part *Part) IsMultipart() bool {
+	return strings.HasPrefix(part.contentType, CT_MP_PREFIX)
+}
+
+// Children returns the parts of a multipart in the order they appear.
+func (part *Part) Children() []*Part {
+	return part.children
+}
+
+// Message returns the message embedded in a message/rfc822 part, or nil for
+// other parts and for embedded messages that could not be parsed.
+func (part *Part) Message() *Message {
+	return part.message
+}
+
+// HeaderOffset returns where the headers of the part start.
+func (part *Part) HeaderOffset() int64 {
+	return part.headerStart
+}
+
+// Offset returns where the content of the part starts.
+func (part *Part) Offset() int64 {
+	return part.start
+}
+
+// Length returns the size of the content of the part in bytes.
+func (part *Part) Length() int64 {
+	return part.end - part.start
+}
+
+// Reader returns a reader over the content of the part decoded from its
+// transfer encoding. The content is read from the mailbox lazily.
+func (part *Part) Reader() io.Reader {
+	return newTransferDecoder(part.RawReader(), part.transferEncoding())
+}
+
+// TextReader returns a reader over the content of a text part decoded from
+// its transfer encoding and converted to UTF-8. The content of other parts
+// is returned as Reader does.
+func (part *Part) TextReader() io.Reader {
+	if !strings.HasPrefix(part.contentType, "text/") {
+		return part.Reader()
+	}
+	return newUtf8Reader(part.Reader(), part.contentType, part.Charset())
+}
+
+// Charset returns the lower-cased charset parameter of the Content-Type
+// header as declared, which may be empty or wrong.
+func (part *Part) Charset() string {
+	return strings.ToLower(strings.Trim(part.Param("charset"), " \t"))
+}
+
+func (part *Part) transferEncoding() string {
+	if transEnc, ok := part.headers[string(H_TR_ENC)]; ok && len(transEnc) > 0 {
+		return strings.ToLower(strings.TrimSpace(transEnc[0]))
+	}
+	return TR_ENC_7BIT
+}
+
+// RawReader returns a reader over the content of the part still in its
+// transfer encoding.
+func (part *Part) RawReader() io.Reader {
+	return newContentReader(part.source, part.base+part.start, part.end-part.start, part.quoting)
+}
+
+// Contents returns the content of the part decoded from its transfer encoding.
+func (part *Part) Contents() ([]byte, error) {
+	return ioutil.ReadAll(part.Reader())
+}
+
+// Walk calls walkFn for the part and then for all of its descendants, depth
+// first and in the order they appear. Walking stops at the first error,
+// except for SkipPart, which only skips the children of the part.
+func (part *Part) Walk(walkFn WalkFunc) error {
+	return part.walk(walkFn, 0)
+}
+
+func (part *Part) walk(walkFn WalkFunc, depth int) error {
+	err := walkFn(part, depth)
+	if err == SkipPart {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range part.children {
+		err = child.walk(walkFn, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
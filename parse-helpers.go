@@ -1,123 +1,273 @@
 package mbox_reader
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/base64"
-	"errors"
+	"io"
 	"io/ioutil"
 	"mime/quotedprintable"
-	"regexp"
-	"sort"
+	"net/url"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
 func reachedNewMessage(line string) bool {
-	return strings.HasPrefix(line, "From ") || strings.HasPrefix(line, ">From ")
+	return strings.HasPrefix(line, "From ")
 }
 
+// unquoteFromLine reverses the From-quoting of a body line. mboxrd removes
+// one ">" from lines matching ^>+From , mboxo and mboxcl only from lines
+// matching ^>From , and mboxcl2 does not quote at all.
+func unquoteFromLine(line string, format MboxFormat) string {
+	if format == MBOX_FMT_MBOXCL2 {
+		return line
+	}
+	unquoted := strings.TrimLeft(line, ">")
+	quotesCount := len(line) - len(unquoted)
+	if quotesCount == 0 || !strings.HasPrefix(unquoted, "From ") {
+		return line
+	}
+	if quotesCount == 1 || format == MBOX_FMT_MBOXRD {
+		return line[1:]
+	}
+	return line
+}
+
+// fromUnquoter is a reader removing the From-quoting from the lines it
+// passes through, as unquoteFromLine does for a single line.
+type fromUnquoter struct {
+	reader      *bufio.Reader
+	format      MboxFormat
+	atLineStart bool
+}
+
+// maxQuotedPrefixLen is how far a line is looked into for a quoted "From ".
+const maxQuotedPrefixLen = 256
+
+func newFromUnquoter(reader io.Reader, format MboxFormat) *fromUnquoter {
+	return &fromUnquoter{
+		reader:      bufio.NewReader(reader),
+		format:      format,
+		atLineStart: true,
+	}
+}
+
+func (unquoter *fromUnquoter) Read(buffer []byte) (int, error) {
+	var count int
+	for count < len(buffer) {
+		if unquoter.atLineStart {
+			unquoter.atLineStart = false
+			prefix, _ := unquoter.reader.Peek(maxQuotedPrefixLen)
+			if len(unquoteFromLine(string(prefix), unquoter.format)) < len(prefix) {
+				unquoter.reader.Discard(1)
+			}
+		}
+		char, err := unquoter.reader.ReadByte()
+		if err != nil {
+			if count > 0 {
+				return count, nil
+			}
+			return 0, err
+		}
+		buffer[count] = char
+		count += 1
+		unquoter.atLineStart = char == '\n'
+	}
+	return count, nil
+}
+
+// stringIsHeaderName reports whether line is a field name, which RFC 5322
+// limits to printable US-ASCII characters other than the colon.
 func stringIsHeaderName(line string) bool {
-	bSlice := []byte(line)
-	badChars := []byte("\t\n\r :")
-	badCharsLen := len(badChars)
-
-	for _, item := range bSlice {
-		ind := sort.Search(badCharsLen, func(i int) bool {
-			return badChars[i] >= item
-		})
-		if ind < badCharsLen && badChars[ind] == item {
+	for idx := 0; idx < len(line); idx++ {
+		if line[idx] < 33 || line[idx] > 126 || line[idx] == ':' {
 			return false
 		}
 	}
 	return true
 }
 
-func parseHeaderLine(line string) (name string, value string, err error) {
+// splitHeaderLine splits a header line into its upper-cased name and raw
+// value. nameLen is the length of the name as spelled in line. A
+// continuation line has no name and keeps its leading white space.
+func splitHeaderLine(line string) (name string, value string, nameLen int) {
 	colonIndex := strings.Index(line, ":")
-	if colonIndex != -1 {
-		hparts := strings.SplitN(line, ":", 2)
-		if stringIsHeaderName(hparts[0]) == true {
-			name = strings.ToUpper(hparts[0])
-			value = decodeMimeEncoded(hparts[1])
-			return
-		}
+	if colonIndex != -1 && stringIsHeaderName(line[:colonIndex]) {
+		return strings.ToUpper(line[:colonIndex]), strings.TrimLeft(line[colonIndex+1:], " "), colonIndex
 	}
+	return "", line, 0
+}
 
-	value = decodeMimeEncoded(line)
+func parseHeaderLine(line string) (name string, value string, err error) {
+	name, value, _ = splitHeaderLine(line)
+	value = strings.TrimLeft(decodeMimeEncoded(value), " ")
 	return
 }
 
+// isMimeEncoded reports whether line is a single RFC 2047 encoded word.
 func isMimeEncoded(line string) bool {
-	line = strings.ToLower(line)
-	prefixOk := strings.HasPrefix(line, "=?")
-	suffixOk := strings.HasSuffix(line, "?=")
-	encIdx := strings.Index(line, "?b?")
-	if encIdx == -1 {
-		encIdx = strings.Index(line, "?q?")
-	}
-	return prefixOk == true && suffixOk == true && encIdx != -1 &&
-		encIdx > 4 && len(line)-1-encIdx > 4
+	end, _, _, ok := parseEncodedWord(line, 0)
+	return ok && end == len(line)
 }
 
+// decodeMimeEncoded decodes the RFC 2047 encoded words of a header value,
+// wherever they start. White space between adjacent encoded words is
+// dropped, and adjacent words in the same charset are converted together so
+// a character split between them survives. Words that can not be decoded are
+// kept as they are.
 func decodeMimeEncoded(line string) string {
-	items := strings.Split(line, " ")
-	var resultLine []byte
-	var prevIsMimeEncoded = false
-	var err error
-	for _, item := range items {
-		if isMimeEncoded(item) {
-			rgx, _ := regexp.Compile(`([a-zA-Z0-9\-\*]+=\")?=\?([a-zA-Z0-9\-]+)\?([qbQB])\?([a-zA-Z=0-9\"\_\+\-\/\.]+)\?=(\")?`)
-			matches := rgx.FindStringSubmatch(item)
-
-			prefix := matches[1]
-			charsetEnc := strings.ToLower(matches[2])
-			transitEnc := strings.ToLower(matches[3])
-			value := matches[4]
-			postfix := matches[5]
-
-			decoded := make([]byte, len(value))
-			if transitEnc == "q" {
-				decoded, err = ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
-			} else if transitEnc == "b" {
-				decoded, err = base64.StdEncoding.DecodeString(value)
-			}
+	var result strings.Builder
+	var pending []byte
+	var pendingCharset string
+	var lastWasWord bool
+	flush := func() {
+		if pending != nil {
+			result.WriteString(convertWordToUtf8(pending, pendingCharset))
+			pending = nil
+		}
+	}
 
-			if err != nil {
-				if prevIsMimeEncoded == false {
-					resultLine = append(resultLine, []byte(" ")...)
-				}
-				resultLine = append(resultLine, []byte(item)...)
-				continue
-			}
+	pos := 0
+	for {
+		start, end, charsetName, decoded := findEncodedWord(line, pos)
+		if start == -1 {
+			break
+		}
+		between := line[pos:start]
+		if !lastWasWord || strings.Trim(between, " \t\r\n") != "" {
+			flush()
+			result.WriteString(between)
+		} else if charsetName != pendingCharset {
+			flush()
+		}
+		pending = append(pending, decoded...)
+		pendingCharset = charsetName
+		lastWasWord = true
+		pos = end
+	}
+	flush()
+	result.WriteString(line[pos:])
+	return result.String()
+}
 
-			var convItem = make([]byte, len(decoded))
-			encoding, _ := charset.Lookup(charsetEnc)
-			convItem, err = encoding.NewDecoder().Bytes(decoded)
-			if err != nil {
-				if prevIsMimeEncoded == false {
-					resultLine = append(resultLine, []byte(" ")...)
-				}
-				resultLine = append(resultLine, item...)
-				continue
-			}
+// findEncodedWord finds the first encoded word at or after pos that can be
+// decoded. start is -1 when there is none.
+func findEncodedWord(line string, pos int) (start int, end int, charsetName string, decoded []byte) {
+	for {
+		idx := strings.Index(line[pos:], "=?")
+		if idx == -1 {
+			return -1, 0, "", nil
+		}
+		start = pos + idx
+		end, charsetName, decoded, ok := parseEncodedWord(line, start)
+		if ok {
+			return start, end, charsetName, decoded
+		}
+		pos = start + 2
+	}
+}
 
-			if prevIsMimeEncoded == false {
-				resultLine = append(resultLine, []byte(" ")...)
-			}
+// parseEncodedWord parses an encoded word "=?charset?encoding?text?=" at
+// start. The charset may carry an RFC 2231 language, as in "utf-8*en". The
+// text ends at the first "?=" that is not followed by a letter or digit, so
+// "?" and "=" may appear in it as sloppy encoders leave them.
+func parseEncodedWord(line string, start int) (end int, charsetName string, decoded []byte, ok bool) {
+	if !strings.HasPrefix(line[start:], "=?") {
+		return 0, "", nil, false
+	}
+	rest := line[start+2:]
+	charsetEnd := strings.IndexAny(rest, "? \t\r\n")
+	if charsetEnd <= 0 || rest[charsetEnd] != '?' || len(rest) < charsetEnd+3 || rest[charsetEnd+2] != '?' {
+		return 0, "", nil, false
+	}
+	charsetName = strings.ToLower(rest[:charsetEnd])
+	if langIdx := strings.Index(charsetName, "*"); langIdx != -1 {
+		charsetName = charsetName[:langIdx]
+	}
+	encoding := rest[charsetEnd+1]
+	textStart := start + 2 + charsetEnd + 3
+
+	textEnd := -1
+	for idx := textStart; idx+1 < len(line); idx++ {
+		char := line[idx]
+		if char == ' ' || char == '\t' || char == '\r' || char == '\n' {
+			break
+		}
+		if char != '?' || line[idx+1] != '=' {
+			continue
+		}
+		if textEnd == -1 {
+			textEnd = idx
+		}
+		if idx+2 == len(line) || !isAlphaNumeric(line[idx+2]) {
+			textEnd = idx
+			break
+		}
+	}
+	if textEnd == -1 {
+		return 0, "", nil, false
+	}
+
+	text := line[textStart:textEnd]
+	switch encoding {
+	case 'b', 'B':
+		decoded, ok = decodeWordBase64(text)
+	case 'q', 'Q':
+		decoded, ok = decodeWordQ(text), true
+	}
+	return textEnd + 2, charsetName, decoded, ok
+}
 
-			resultLine = append(resultLine, prefix...)
-			resultLine = append(resultLine, convItem...)
-			resultLine = append(resultLine, postfix...)
-			prevIsMimeEncoded = true
-		} else {
-			resultLine = append(resultLine, []byte(" ")...)
-			resultLine = append(resultLine, item...)
-			prevIsMimeEncoded = false
+func decodeWordBase64(text string) ([]byte, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "="))
+	}
+	return decoded, err == nil
+}
+
+// decodeWordQ decodes the Q encoding, where "_" stands for a space. Broken
+// escapes are kept as they are.
+func decodeWordQ(text string) []byte {
+	decoded := make([]byte, 0, len(text))
+	for idx := 0; idx < len(text); idx++ {
+		switch {
+		case text[idx] == '_':
+			decoded = append(decoded, ' ')
+		case text[idx] == '=' && idx+2 < len(text) && isHexDigit(text[idx+1]) && isHexDigit(text[idx+2]):
+			value, _ := strconv.ParseUint(text[idx+1:idx+3], 16, 8)
+			decoded = append(decoded, byte(value))
+			idx += 2
+		default:
+			decoded = append(decoded, text[idx])
 		}
 	}
-	resultLine = bytes.TrimLeft(resultLine, " ")
-	return string(resultLine)
+	return decoded
+}
+
+// convertWordToUtf8 converts the text of encoded words to UTF-8. Text in an
+// unknown charset is kept when it is valid UTF-8 and has its invalid bytes
+// replaced otherwise.
+func convertWordToUtf8(text []byte, charsetName string) string {
+	if enc, _ := charset.Lookup(charsetName); enc != nil {
+		if converted, err := enc.NewDecoder().Bytes(text); err == nil {
+			return string(converted)
+		}
+	}
+	return strings.ToValidUTF8(string(text), "\uFFFD")
+}
+
+func isHexDigit(char byte) bool {
+	return (char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')
+}
+
+func isAlphaNumeric(char byte) bool {
+	return isHexDigit(char) || (char >= 'g' && char <= 'z') || (char >= 'G' && char <= 'Z')
 }
 
 func decodeFromTransferEncoding(rawContent string, transEnc string) (string, error) {
@@ -139,45 +289,246 @@ func decodeFromTransferEncoding(rawContent string, transEnc string) (string, err
 	}
 }
 
-func messageIsMultipart(msg *Message) (isMultipart bool, boundary string, err error) {
-	isMultipart = false
+// newTransferDecoder wraps a reader so that it yields the content decoded
+// from the given Content-Transfer-Encoding. 7bit, 8bit, binary and unknown
+// encodings are passed through unchanged.
+func newTransferDecoder(reader io.Reader, transEnc string) io.Reader {
+	transEnc = strings.ToLower(strings.TrimSpace(transEnc))
+	if transEnc == TR_ENC_QPRNT {
+		return quotedprintable.NewReader(reader)
+	} else if transEnc == TR_ENC_B64 {
+		return base64.NewDecoder(base64.StdEncoding, reader)
+	}
+	return reader
+}
+
+func getMimeTypeFromCType(ctype string) string {
+	splitted := strings.Split(ctype, ";")
+	return strings.Trim(splitted[0], " \t")
+}
+
+// getParamFromHeader returns a parameter of a structured header value such as
+// Content-Type or Content-Disposition. RFC 2231 continuations (name*0, name*1)
+// are joined, extended values (name*=charset'lang'value) are decoded, and so
+// are RFC 2047 encoded words that some mailers put into quoted values.
+func getParamFromHeader(value string, name string) string {
+	name = strings.ToLower(name)
+	var plainValue, extValue string
+	var hasPlain, hasExt bool
+	pieces := make(map[int]string)
+	extPieces := make(map[int]bool)
+
+	for _, param := range splitHeaderParams(value)[1:] {
+		eqIdx := strings.Index(param, "=")
+		if eqIdx == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.Trim(param[:eqIdx], " \t"))
+		val := unquoteParamValue(strings.Trim(param[eqIdx+1:], " \t"))
 
-	ctype, ok := msg.headers[string(H_CT_TYPE)]
-	if !ok {
-		err = errors.New("The message does not have a Content-Type header")
-		return
+		if key == name {
+			plainValue, hasPlain = val, true
+		} else if key == name+"*" {
+			extValue, hasExt = val, true
+		} else if strings.HasPrefix(key, name+"*") {
+			idxStr := key[len(name)+1:]
+			isExt := strings.HasSuffix(idxStr, "*")
+			idx, err := strconv.Atoi(strings.TrimSuffix(idxStr, "*"))
+			if err != nil {
+				continue
+			}
+			pieces[idx] = val
+			extPieces[idx] = isExt
+		}
+	}
+
+	if hasExt {
+		charsetName, rest := splitExtParamValue(extValue)
+		return convertToUtf8(unescapeParamValue(rest), charsetName)
+	}
+	if len(pieces) > 0 {
+		var joined string
+		var charsetName string
+		for idx := 0; ; idx++ {
+			piece, ok := pieces[idx]
+			if !ok {
+				break
+			}
+			if extPieces[idx] {
+				if idx == 0 {
+					charsetName, piece = splitExtParamValue(piece)
+				}
+				piece = unescapeParamValue(piece)
+			}
+			joined += piece
+		}
+		return decodeMimeEncoded(convertToUtf8(joined, charsetName))
 	}
+	if hasPlain {
+		return decodeMimeEncoded(plainValue)
+	}
+	return ""
+}
 
-	if strings.HasPrefix(ctype[0], CT_MP_MIXED) || strings.HasPrefix(ctype[0], CT_MP_RELATED) {
-		isMultipart = true
-		boundary = getBoundaryFromCType(ctype[0])
-		if boundary == "" {
-			err = errors.New("The message is multipart but a boundary is empty")
-			return
+// getParamsFromHeader returns all parameters of a header value keyed by
+// their lower-cased names, with RFC 2231 continuations joined.
+func getParamsFromHeader(value string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range splitHeaderParams(value)[1:] {
+		eqIdx := strings.Index(param, "=")
+		if eqIdx == -1 {
+			continue
+		}
+		name := strings.ToLower(strings.Trim(param[:eqIdx], " \t"))
+		if starIdx := strings.Index(name, "*"); starIdx != -1 {
+			name = name[:starIdx]
 		}
+		if _, ok := params[name]; ok || name == "" {
+			continue
+		}
+		params[name] = getParamFromHeader(value, name)
 	}
-	return
+	return params
 }
 
-func getBoundaryFromCType(ctype string) string {
-	r, _ := regexp.Compile(`.+boundary=(\")?([^\"\n]+)(\")?.*`)
-	matches := r.FindStringSubmatch(ctype)
-	if matches[2] != "" {
-		return matches[2]
+// splitHeaderParams splits a header value on semicolons that are not inside
+// a quoted string.
+func splitHeaderParams(value string) []string {
+	var params []string
+	var current []byte
+	inQuotes := false
+	for idx := 0; idx < len(value); idx++ {
+		char := value[idx]
+		if char == '\\' && inQuotes && idx+1 < len(value) {
+			current = append(current, char, value[idx+1])
+			idx++
+			continue
+		}
+		if char == '"' {
+			inQuotes = !inQuotes
+		}
+		if char == ';' && !inQuotes {
+			params = append(params, string(current))
+			current = current[:0]
+			continue
+		}
+		current = append(current, char)
 	}
-	return ""
+	return append(params, string(current))
 }
 
-func getMimeTypeFromCType(ctype string) string {
-	splitted := strings.Split(ctype, ";")
-	return strings.Trim(splitted[0], " \t")
+func unquoteParamValue(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	value = value[1 : len(value)-1]
+	var result []byte
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] == '\\' && idx+1 < len(value) {
+			idx++
+		}
+		result = append(result, value[idx])
+	}
+	return string(result)
+}
+
+// splitExtParamValue splits an RFC 2231 charset'language'value into
+// the charset name and the still percent-encoded value.
+func splitExtParamValue(value string) (charsetName string, rest string) {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return "", value
+	}
+	return parts[0], parts[2]
+}
+
+func unescapeParamValue(value string) string {
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		return value
+	}
+	return unescaped
+}
+
+// convertToUtf8 converts a string from the named charset, leaving it as is
+// when the charset is unknown or the conversion fails.
+func convertToUtf8(value string, charsetName string) string {
+	if charsetName == "" {
+		return value
+	}
+	encoding, _ := charset.Lookup(charsetName)
+	if encoding == nil {
+		return strings.ToValidUTF8(value, "\uFFFD")
+	}
+	converted, err := encoding.NewDecoder().String(value)
+	if err != nil {
+		return value
+	}
+	return converted
+}
+
+// charsetSniffLen is how much of a body is looked at to detect its charset.
+const charsetSniffLen = 1024
+
+// newUtf8Reader converts text in the declared charset to UTF-8. When the
+// charset is missing, unknown or contradicted by the content, it is detected
+// from a byte order mark, an HTML <meta charset> or the content itself.
+func newUtf8Reader(reader io.Reader, mimeType string, declared string) io.Reader {
+	buffered := bufio.NewReaderSize(reader, charsetSniffLen)
+	prefix, _ := buffered.Peek(charsetSniffLen)
+	return transform.NewReader(buffered, detectCharset(prefix, mimeType, declared).NewDecoder())
+}
+
+func detectCharset(prefix []byte, mimeType string, declared string) encoding.Encoding {
+	if declared != "" {
+		enc, name := charset.Lookup(declared)
+		switch {
+		case enc == nil:
+		case name == "utf-8" && !isUtf8Prefix(prefix, len(prefix) < charsetSniffLen):
+		case strings.Contains(declared, "ascii") && !isAsciiText(prefix):
+		default:
+			return enc
+		}
+	}
+	enc, _, _ := charset.DetermineEncoding(prefix, mimeType)
+	return enc
+}
+
+// isUtf8Prefix reports whether text is valid UTF-8. Unless the text is
+// complete, it may end in the middle of a character.
+func isUtf8Prefix(text []byte, complete bool) bool {
+	if !complete {
+		for cut := 1; cut < utf8.UTFMax && cut <= len(text); cut++ {
+			if utf8.RuneStart(text[len(text)-cut]) {
+				if !utf8.FullRune(text[len(text)-cut:]) {
+					text = text[:len(text)-cut]
+				}
+				break
+			}
+		}
+	}
+	return utf8.Valid(text)
 }
 
-func getCharsetFromCType(ctype string) string {
-	r, _ := regexp.Compile(`.+charset=(\")?([^\"\n]+)(\")?.*`)
-	matches := r.FindStringSubmatch(ctype)
-	if matches[2] != "" {
-		return matches[2]
+func isAsciiText(text []byte) bool {
+	for _, char := range text {
+		if char >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// getAttachmentFileName returns the file name of a section, taken from the
+// Content-Disposition filename parameter or the Content-Type name parameter.
+func getAttachmentFileName(headers map[string][]string) string {
+	if disposition, ok := headers[string(H_CT_DISP)]; ok && len(disposition) > 0 {
+		if fileName := getParamFromHeader(disposition[0], "filename"); fileName != "" {
+			return fileName
+		}
+	}
+	if ctype, ok := headers[string(H_CT_TYPE)]; ok && len(ctype) > 0 {
+		return getParamFromHeader(ctype[0], "name")
 	}
 	return ""
 }
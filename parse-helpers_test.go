@@ -93,3 +93,29 @@ func TestIsMimeEncoded(t *testing.T) {
 		})
 	}
 }
+
+func TestGetParamFromHeader(t *testing.T) {
+	type GetParamFromHeaderTestCase struct {
+		Header string `json:"header"`
+		Param  string `json:"param"`
+		Value  string `json:"value"`
+	}
+	testTable := make([]GetParamFromHeaderTestCase, 7)
+	data, err := ioutil.ReadFile("testcases/get_param_from_header_cases.json")
+	if err != nil {
+		t.Error(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			value := getParamFromHeader(tcase.Header, tcase.Param)
+			if value != tcase.Value {
+				t.Errorf("\nheader: %s\nwant: %s\ngot: %s\n", tcase.Header, tcase.Value, value)
+			}
+		})
+	}
+}
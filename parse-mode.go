@@ -0,0 +1,73 @@
+package mbox_reader
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseMode tells the reader what to do with messages that can not be parsed.
+type ParseMode int
+
+const (
+	// PARSE_MODE_STRICT makes Read fail on the first malformed message.
+	PARSE_MODE_STRICT ParseMode = iota
+	// PARSE_MODE_LENIENT returns malformed messages parsed as far as possible,
+	// with the problems found listed by Message.Warnings. Text that does not
+	// start with a From_ line is skipped and reported.
+	PARSE_MODE_LENIENT
+	// PARSE_MODE_SKIP skips malformed messages and reports them.
+	PARSE_MODE_SKIP
+)
+
+// ParseWarning is a problem found in a message parsed in lenient mode.
+// Offset is where it was found, relative to the beginning of the message.
+type ParseWarning struct {
+	Offset int64
+	Err    error
+}
+
+func (warning ParseWarning) Error() string {
+	return fmt.Sprintf("offset %d: %s", warning.Offset, warning.Err)
+}
+
+func (warning ParseWarning) Unwrap() error {
+	return warning.Err
+}
+
+// SkippedMessage is a message the reader skipped because it could not be
+// parsed. Offset and Length locate it in the mailbox.
+type SkippedMessage struct {
+	Offset int64
+	Length int64
+	Err    error
+}
+
+// Warnings returns the problems found while parsing the message in lenient
+// mode, in the order they were found.
+func (message Message) Warnings() []ParseWarning {
+	return message.warnings
+}
+
+// tolerate records err as a warning and drops it when the message is parsed
+// leniently. Otherwise it is returned with its offset, which newParseError
+// picks up.
+func (message *Message) tolerate(err error, offset int64) error {
+	if err == nil {
+		return nil
+	}
+	warning := ParseWarning{Offset: offset, Err: err}
+	if !message.lenient {
+		return warning
+	}
+	message.warnings = append(message.warnings, warning)
+	return nil
+}
+
+// parseMessageWithMode parses a message in the given mode. In lenient mode
+// only text that does not start with a From_ line and read errors fail.
+func parseMessageWithMode(msg *Message, mode ParseMode) error {
+	msg.lenient = mode == PARSE_MODE_LENIENT && strings.HasPrefix(msg.envelope, "From ")
+	err := parseMessage(msg)
+	msg.lenient = false
+	return err
+}
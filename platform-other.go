@@ -0,0 +1,19 @@
+//go:build !unix
+
+package mbox_reader
+
+import (
+	"errors"
+	"os"
+)
+
+func tryFcntlLock(file *os.File, exclusive bool) (bool, error) {
+	return false, errors.New("fcntl locks are not supported on this system")
+}
+
+func unlockFcntl(file *os.File) error {
+	return nil
+}
+
+func chownFile(file *os.File, stat os.FileInfo) {
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package mbox_reader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// tryFcntlLock takes an fcntl(2) lock on the whole file without waiting.
+// The lock belongs to the process and is lost when any descriptor of the
+// file is closed, so it is taken on the descriptor the mailbox is read from.
+func tryFcntlLock(file *os.File, exclusive bool) (bool, error) {
+	lockType := int16(syscall.F_RDLCK)
+	if exclusive {
+		lockType = syscall.F_WRLCK
+	}
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   lockType,
+		Whence: io.SeekStart,
+	})
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFcntl(file *os.File) error {
+	return syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: io.SeekStart,
+	})
+}
+
+// chownFile gives file the owner and group in stat, if allowed.
+func chownFile(file *os.File, stat os.FileInfo) {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		file.Chown(int(sys.Uid), int(sys.Gid))
+	}
+}
@@ -0,0 +1,51 @@
+package mbox_reader
+
+import (
+	"context"
+)
+
+// Begin starts a read session: the mailbox file stays locked with a shared
+// lock until End, instead of being locked for every Read, and reading stops
+// at the end the mailbox had when the session began, so messages appended
+// later are not returned. Begin waits for the lock as Read does. It does
+// nothing for a reader over a stream, which is never locked. A dot lock
+// held by the session is refreshed on every Read, so it does not grow stale
+// during a long scan.
+func (mboxReader *MboxReader) Begin(ctx context.Context) error {
+	if mboxReader.file == nil {
+		return nil
+	}
+	if mboxReader.session != nil {
+		return ErrSessionActive
+	}
+	lock, err := mboxReader.lockFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	stat, err := mboxReader.file.Stat()
+	if err == nil {
+		err = mboxReader.reader.limitTo(stat.Size())
+	}
+	if err != nil {
+		lock.Unlock()
+		return err
+	}
+	mboxReader.session = lock
+	mboxReader.snapshotSize = stat.Size()
+	return nil
+}
+
+// End finishes a read session, releasing the lock. Reading may go on after
+// it, locking for every Read again and seeing the messages appended since.
+func (mboxReader *MboxReader) End() error {
+	if mboxReader.session == nil {
+		return nil
+	}
+	err := mboxReader.session.Unlock()
+	mboxReader.session = nil
+	limitErr := mboxReader.reader.limitTo(-1)
+	if err == nil {
+		err = limitErr
+	}
+	return err
+}
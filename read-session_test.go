@@ -0,0 +1,119 @@
+package mbox_reader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+func TestReadSession(t *testing.T) {
+	mboxPath := copyMailbox(t, "mboxrd.mbox")
+	appended, err := ioutil.ReadFile("testcases/distinct-messages/message1.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mboxReader.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mboxReader.Begin(context.Background()); !errors.Is(err, ErrSessionActive) {
+		t.Errorf("Sessions must not nest, got:%v\n", err)
+	}
+
+	writerLock := flock.New(mboxPath)
+	if locked, _ := writerLock.TryLock(); locked {
+		writerLock.Unlock()
+		t.Error("A writer must be kept out during the session")
+	}
+
+	_, err = mboxReader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(mboxPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(append([]byte("\n"), appended...))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var senders []string
+	for {
+		msg, err := mboxReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		senders = append(senders, msg.Sender())
+	}
+	if len(senders) != 1 || senders[0] != "second@mail.com" {
+		t.Errorf("Messages appended during the session must not be read, got:%v\n", senders)
+	}
+
+	err = mboxReader.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := writerLock.TryLock(); !locked {
+		t.Error("The lock must be released by End")
+	}
+	writerLock.Unlock()
+
+	msg, err := mboxReader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Sender() != "randsender@mail.com" {
+		t.Errorf("The appended message must be read after the session, got:%s\n", msg.Sender())
+	}
+}
+
+func TestReadSessionDotlock(t *testing.T) {
+	mboxPath := copyMailbox(t, "mboxrd.mbox")
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxReader.SetLockStrategy(LOCK_DOTLOCK)
+	err = mboxReader.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mboxReader.End()
+
+	// a scan running for longer than the stale age
+	dotlock := mboxPath + ".lock"
+	past := time.Now().Add(-2 * DOTLOCK_STALE_AGE)
+	err = os.Chtimes(dotlock, past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mboxReader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(dotlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(stat.ModTime()) >= DOTLOCK_STALE_AGE {
+		t.Error("The dot lock must be refreshed by Read within a session")
+	}
+}
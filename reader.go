@@ -1,167 +1,450 @@
 package mbox_reader
 
 import (
-	"errors"
+	"context"
+	"io"
 	"os"
+	"path"
+	"regexp"
+	"strings"
 	"time"
-
-	"github.com/gofrs/flock"
 )
 
+// MboxReader reads messages from a mailbox one by one, skipping those
+// that do not pass the configured filters.
 type MboxReader struct {
 	headerFilters         map[string]string
-	headerRegexFilters    map[string]string
+	headerRegexFilters    map[string]*regexp.Regexp
+	addressFilters        map[string]string
+	domainFilters         map[string]string
 	afterTime             time.Time
 	beforeTime            time.Time
+	timeSource            TimeSource
 	attachmentNames       []string
-	attachmentNameRegexes []string
+	attachmentNameRegexes []*regexp.Regexp
+	requiredFlags         MessageFlags
+	excludedFlags         MessageFlags
 	file                  *os.File
 	filepath              string
+	reader                *lineReader
+	format                MboxFormat
+	index                 *MboxIndex
 	lockTrialsCount       uint
 	lockTrialsTimeout     uint
+	lockStrategy          LockStrategy
+	session               *mboxLock
+	snapshotSize          int64
+	parseMode             ParseMode
+	skipped               []SkippedMessage
+	nextNumber            int
 }
 
+// MboxReaderIface is the reader API the package promises to keep stable.
 type MboxReaderIface interface {
 	Read() (*Message, error)
-	setAfterTime(time.Time)
-	setBeforeTime(time.Time)
-	withHeader(string, string)
-	withHeaderRegex(string, string)
-	withAttachmentName(string)
-	withAttachmentNameRegex(string)
-	setFilePath(filepath string) (*MboxReaderIface, error)
-	resetFilters()
+	ReadContext(context.Context) (*Message, error)
+	Begin(context.Context) error
+	End() error
+	SetAfterTime(time.Time) *MboxReader
+	SetBeforeTime(time.Time) *MboxReader
+	SetTimeSource(TimeSource) *MboxReader
+	WithHeader(string, string) *MboxReader
+	WithHeaderRegex(string, string) (*MboxReader, error)
+	WithAddress(string, string) *MboxReader
+	WithAddressDomain(string, string) *MboxReader
+	WithAttachmentName(string) *MboxReader
+	WithAttachmentNameRegex(string) (*MboxReader, error)
+	WithFlags(MessageFlags) *MboxReader
+	WithoutFlags(MessageFlags) *MboxReader
+	SetFlags(*Message, MessageFlags) error
+	SetFlagsContext(context.Context, *Message, MessageFlags) error
+	Expunge(bool) ([]MboxIndexEntry, error)
+	ExpungeContext(context.Context, bool) ([]MboxIndexEntry, error)
+	SetFilePath(filepath string) (*MboxReader, error)
+	SetFormat(MboxFormat) *MboxReader
+	SetLockStrategy(LockStrategy) *MboxReader
+	SetParseMode(ParseMode) *MboxReader
+	SkippedMessages() []SkippedMessage
+	BuildIndex() (*MboxIndex, error)
+	SetIndex(*MboxIndex) error
+	SeekMessage(int) error
+	ReadMessage(int) (*Message, error)
+	ResetFilters() *MboxReader
 }
 
+var _ MboxReaderIface = (*MboxReader)(nil)
+
+// NewMboxReader opens the mailbox at filepath. The file is locked for every
+// Read, retrying up to lockTrialsCount times when it is locked by someone
+// else, with a growing pause between trials, for at most lockTrialsTimeout
+// milliseconds in total. A lockTrialsTimeout of 0 puts no limit on the time.
 func NewMboxReader(filepath string, lockTrialsCount uint, lockTrialsTimeout uint) (*MboxReader, error) {
 	file, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
 
+	reader, err := newFileLineReader(file, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
 	mboxReader := &MboxReader{
 		file:              file,
 		filepath:          filepath,
+		reader:            reader,
 		lockTrialsCount:   lockTrialsCount,
 		lockTrialsTimeout: lockTrialsTimeout,
+		lockStrategy:      LOCK_FLOCK,
 	}
 	mboxReader.headerFilters = make(map[string]string)
-	mboxReader.headerRegexFilters = make(map[string]string)
+	mboxReader.headerRegexFilters = make(map[string]*regexp.Regexp)
+	mboxReader.addressFilters = make(map[string]string)
+	mboxReader.domainFilters = make(map[string]string)
 
 	return mboxReader, nil
 }
 
-func (mboxReader *MboxReader) Read() (*Message, error) {
-	filelock, err := mboxReader.lockFile()
-	if err != nil {
-		return nil, err
+// NewMboxReaderFromReader creates a reader over an arbitrary stream such as
+// stdin, an HTTP body or a tar entry. The stream is never seeked and,
+// since there is no file behind it, no lock is taken while reading. Every
+// message returned keeps its raw bytes in memory.
+func NewMboxReaderFromReader(reader io.Reader) *MboxReader {
+	mboxReader := &MboxReader{
+		reader:       newLineReader(reader),
+		lockStrategy: LOCK_FLOCK,
 	}
+	mboxReader.headerFilters = make(map[string]string)
+	mboxReader.headerRegexFilters = make(map[string]*regexp.Regexp)
+	mboxReader.addressFilters = make(map[string]string)
+	mboxReader.domainFilters = make(map[string]string)
 
-	defer filelock.Unlock()
+	return mboxReader
+}
 
-	msg := Message{}
+// Read returns the next message passing all filters. When there are no
+// more messages in the mailbox it returns io.EOF. Unless the parse mode is
+// PARSE_MODE_STRICT, messages that can not be parsed are skipped, reported
+// by SkippedMessages, and reading goes on from the next From_ line.
+func (mboxReader *MboxReader) Read() (*Message, error) {
+	return mboxReader.ReadContext(context.Background())
+}
 
-	foundMsg := false
-	for {
-		msg, err = readMsgContent(mboxReader.file)
+// ReadContext is Read giving up waiting for the mailbox lock when ctx is done.
+func (mboxReader *MboxReader) ReadContext(ctx context.Context) (*Message, error) {
+	if mboxReader.file != nil {
+		filelock, err := mboxReader.lockFile(ctx, false)
 		if err != nil {
 			return nil, err
 		}
+		defer filelock.Unlock()
+	}
 
-		err = parseMessage(&msg)
+	for {
+		msg, err := mboxReader.readMsgContent()
 		if err != nil {
 			return nil, err
 		}
 
-		foundMsg = true
+		err = parseMessageWithMode(&msg, mboxReader.parseMode)
+		if err != nil {
+			err = mboxReader.newParseError(&msg, err)
+			if mboxReader.parseMode == PARSE_MODE_STRICT {
+				return nil, err
+			}
+			mboxReader.skipped = append(mboxReader.skipped, SkippedMessage{
+				Offset: msg.offset,
+				Length: msg.length,
+				Err:    err,
+			})
+			continue
+		}
 
-		if !mboxReader.afterTime.IsZero() && mboxReader.afterTime.After(msg.getTimestamp()) {
-			foundMsg = false
+		if mboxReader.matchFilters(&msg) {
+			return &msg, nil
 		}
-		if !mboxReader.beforeTime.IsZero() && mboxReader.beforeTime.Before(msg.getTimestamp()) {
-			foundMsg = false
+	}
+}
+
+// readMsgContent frames the next message and numbers it.
+func (mboxReader *MboxReader) readMsgContent() (Message, error) {
+	msg, err := readMsgContent(mboxReader.reader, mboxReader.format)
+	if err != nil {
+		return msg, err
+	}
+	msg.number = mboxReader.nextNumber
+	mboxReader.nextNumber++
+	return msg, nil
+}
+
+// matchFilters reports whether the message passes all filters of the reader.
+func (mboxReader *MboxReader) matchFilters(msg *Message) bool {
+	if !mboxReader.afterTime.IsZero() || !mboxReader.beforeTime.IsZero() {
+		timestamp, ok := msg.filterTime(mboxReader.timeSource)
+		if !ok {
+			return false
+		}
+		if !mboxReader.afterTime.IsZero() && mboxReader.afterTime.After(timestamp) {
+			return false
+		}
+		if !mboxReader.beforeTime.IsZero() && mboxReader.beforeTime.Before(timestamp) {
+			return false
 		}
+	}
 
-		for key, value := range mboxReader.headerFilters {
-			msgHeader, ok := msg.getHeader(key)
-			if ok && (len(msgHeader.Values) == 0 || msgHeader.Values[0] != value) {
-				foundMsg = false
+	for key, value := range mboxReader.headerFilters {
+		msgHeader, ok := msg.Header(key)
+		if ok && (len(msgHeader.Values) == 0 || msgHeader.Values[0] != value) {
+			return false
+		}
+	}
+
+	return mboxReader.matchFlagFilters(msg) && mboxReader.matchHeaderRegexFilters(msg) &&
+		mboxReader.matchAddressFilters(msg) && mboxReader.matchAttachmentFilters(msg)
+}
+
+// matchAddressFilters reports whether every address header with a filter
+// lists a matching address. A missing header does not match.
+func (mboxReader *MboxReader) matchAddressFilters(msg *Message) bool {
+	for key, value := range mboxReader.addressFilters {
+		matched := false
+		for _, address := range msg.Addresses(key) {
+			if strings.EqualFold(address.Address(), value) {
+				matched = true
 				break
 			}
 		}
-
-		if foundMsg == true {
-			break
+		if !matched {
+			return false
 		}
 	}
-
-	if foundMsg == false {
-		err = errors.New("End of file")
+	for key, domain := range mboxReader.domainFilters {
+		matched := false
+		for _, address := range msg.Addresses(key) {
+			if addressMatchesDomain(address, domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
 	}
-
-	return &msg, err
+	return true
 }
 
-func (mboxReader *MboxReader) lockFile() (filelock *flock.Flock, err error) {
-	filelock = flock.New(mboxReader.filepath)
-	locked, err := filelock.TryLock()
-	var localTrialsCount uint
-	if err != nil || locked == false {
-		localTrialsCount = 1
-		for localTrialsCount <= mboxReader.lockTrialsCount {
-			locked, err := filelock.TryLock()
-			localTrialsCount += 1
-			if err == nil && locked == true {
-				return filelock, nil
+func (mboxReader *MboxReader) matchHeaderRegexFilters(msg *Message) bool {
+	for key, regex := range mboxReader.headerRegexFilters {
+		msgHeader, ok := msg.Header(key)
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, value := range msgHeader.Values {
+			if regex.MatchString(value) {
+				matched = true
+				break
 			}
 		}
+		if !matched {
+			return false
+		}
 	}
-	if err != nil {
-		return nil, err
+	return true
+}
+
+// matchAttachmentFilters reports whether at least one attachment of the message
+// matches any of the registered attachment names or name patterns. Messages
+// always match when no attachment filters are set.
+func (mboxReader *MboxReader) matchAttachmentFilters(msg *Message) bool {
+	if len(mboxReader.attachmentNames) == 0 && len(mboxReader.attachmentNameRegexes) == 0 {
+		return true
 	}
-	if locked == false {
-		return nil, errors.New("Couldn't lock the file")
+	for _, part := range msg.attachments {
+		fileName := part.getFileName()
+		if fileName == "" {
+			continue
+		}
+		for _, name := range mboxReader.attachmentNames {
+			if name == fileName {
+				return true
+			}
+			if matched, err := path.Match(name, fileName); err == nil && matched {
+				return true
+			}
+		}
+		for _, regex := range mboxReader.attachmentNameRegexes {
+			if regex.MatchString(fileName) {
+				return true
+			}
+		}
 	}
-	return filelock, nil
+	return false
 }
 
+// lockFile locks the mailbox file with the strategy of the reader, waiting
+// for it as long as ctx and the lock trials settings allow. Within a read
+// session the file is already locked, so its dot lock is only refreshed and
+// a lock doing nothing is returned.
+func (mboxReader *MboxReader) lockFile(ctx context.Context, exclusive bool) (*mboxLock, error) {
+	if mboxReader.session != nil {
+		err := mboxReader.session.touch()
+		if err != nil {
+			return nil, err
+		}
+		return newMboxLock(LOCK_NONE, mboxReader.file, mboxReader.filepath), nil
+	}
+	lock := newMboxLock(mboxReader.lockStrategy, mboxReader.file, mboxReader.filepath)
+	return acquireLock(ctx, lock, exclusive, mboxReader.lockTrialsCount, mboxReader.lockTrialsTimeout)
+}
+
+// SetAfterTime skips messages delivered before afterTime.
 func (mboxReader *MboxReader) SetAfterTime(afterTime time.Time) *MboxReader {
 	mboxReader.afterTime = afterTime
 	return mboxReader
 }
 
+// SetBeforeTime skips messages delivered after beforeTime.
 func (mboxReader *MboxReader) SetBeforeTime(beforeTime time.Time) *MboxReader {
 	mboxReader.beforeTime = beforeTime
 	return mboxReader
 }
 
+// SetTimeSource sets which timestamp SetAfterTime and SetBeforeTime are
+// compared with. It is TIME_SRC_ENVELOPE by default.
+func (mboxReader *MboxReader) SetTimeSource(source TimeSource) *MboxReader {
+	mboxReader.timeSource = source
+	return mboxReader
+}
+
+// WithHeader skips messages where the header with the given case-insensitive
+// name is present and its first value is not equal to value.
 func (mboxReader *MboxReader) WithHeader(key string, value string) *MboxReader {
 	mboxReader.headerFilters[key] = value
 	return mboxReader
 }
 
-func (mboxReader *MboxReader) WithHeaderRegex(key string, regex string) *MboxReader {
-	mboxReader.headerRegexFilters[key] = regex
+// WithHeaderRegex adds a filter on the header with the given name. The
+// pattern is compiled immediately and an invalid one is returned as an error.
+// A message passes the filter when the header is present and at least one
+// of its values matches, so a pattern on a multi-valued header such as
+// Received is checked against every occurrence.
+func (mboxReader *MboxReader) WithHeaderRegex(key string, regex string) (*MboxReader, error) {
+	compiled, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	mboxReader.headerRegexFilters[strings.ToUpper(key)] = compiled
+	return mboxReader, nil
+}
+
+// WithAddress keeps only messages where the address header with the given
+// name, such as From or To, lists address. Addresses are compared without
+// regard to case and display names.
+func (mboxReader *MboxReader) WithAddress(key string, address string) *MboxReader {
+	mboxReader.addressFilters[strings.ToUpper(key)] = strings.Trim(address, " \t<>")
+	return mboxReader
+}
+
+// WithAddressDomain keeps only messages where the address header with the
+// given name lists an address in domain or in one of its subdomains.
+func (mboxReader *MboxReader) WithAddressDomain(key string, domain string) *MboxReader {
+	mboxReader.domainFilters[strings.ToUpper(key)] = domain
 	return mboxReader
 }
 
+// WithAttachmentName keeps only messages having an attachment with the given
+// file name. The name may also be a shell pattern such as "*.pdf".
 func (mboxReader *MboxReader) WithAttachmentName(name string) *MboxReader {
 	mboxReader.attachmentNames = append(mboxReader.attachmentNames, name)
 	return mboxReader
 }
 
-func (mboxReader *MboxReader) WithAttachmentNameRegex(regex string) *MboxReader {
-	mboxReader.attachmentNameRegexes = append(mboxReader.attachmentNameRegexes, regex)
+// WithAttachmentNameRegex keeps only messages having an attachment whose file
+// name matches the pattern. An invalid pattern is returned as an error.
+func (mboxReader *MboxReader) WithAttachmentNameRegex(regex string) (*MboxReader, error) {
+	compiled, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, err
+	}
+	mboxReader.attachmentNameRegexes = append(mboxReader.attachmentNameRegexes, compiled)
+	return mboxReader, nil
+}
+
+// SetFormat sets how messages are delimited in the mailbox. It is
+// MBOX_FMT_AUTO by default. An index built for another format is dropped.
+func (mboxReader *MboxReader) SetFormat(format MboxFormat) *MboxReader {
+	if mboxReader.index != nil && mboxReader.index.Format != format {
+		mboxReader.index = nil
+	}
+	mboxReader.format = format
+	return mboxReader
+}
+
+// SetParseMode sets what Read does with malformed messages. It is
+// PARSE_MODE_STRICT by default.
+func (mboxReader *MboxReader) SetParseMode(mode ParseMode) *MboxReader {
+	mboxReader.parseMode = mode
+	return mboxReader
+}
+
+// SkippedMessages returns the messages skipped so far because they could not
+// be parsed, in the order they appear in the mailbox.
+func (mboxReader *MboxReader) SkippedMessages() []SkippedMessage {
+	return mboxReader.skipped
+}
+
+// SetLockStrategy sets how the mailbox file is locked while it is read. It
+// is LOCK_FLOCK by default; use the strategy the mail delivery agent writing
+// the mailbox uses.
+func (mboxReader *MboxReader) SetLockStrategy(strategy LockStrategy) *MboxReader {
+	mboxReader.lockStrategy = strategy
 	return mboxReader
 }
 
+// ResetFilters removes all filters set on the reader.
+func (mboxReader *MboxReader) ResetFilters() *MboxReader {
+	mboxReader.headerFilters = make(map[string]string)
+	mboxReader.headerRegexFilters = make(map[string]*regexp.Regexp)
+	mboxReader.addressFilters = make(map[string]string)
+	mboxReader.domainFilters = make(map[string]string)
+	mboxReader.afterTime = time.Time{}
+	mboxReader.beforeTime = time.Time{}
+	mboxReader.attachmentNames = nil
+	mboxReader.attachmentNameRegexes = nil
+	mboxReader.requiredFlags = 0
+	mboxReader.excludedFlags = 0
+	return mboxReader
+}
+
+// SetFilePath switches the reader to another mailbox file, reading it from
+// the start. A read session in progress is ended and the previous file is
+// closed, so bodies and attachments not yet read from messages of that file
+// can no longer be read.
 func (mboxReader *MboxReader) SetFilePath(filepath string) (*MboxReader, error) {
+	err := mboxReader.End()
+	if err != nil {
+		return nil, err
+	}
 	file, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
 
+	reader, err := newFileLineReader(file, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if mboxReader.file != nil {
+		mboxReader.file.Close()
+	}
 	mboxReader.file = file
 	mboxReader.filepath = filepath
+	mboxReader.reader = reader
+	mboxReader.index = nil
+	mboxReader.nextNumber = 0
 	return mboxReader, nil
 }
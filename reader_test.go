@@ -1,10 +1,16 @@
 package mbox_reader
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -13,6 +19,9 @@ func TestReadWithFilters(t *testing.T) {
 		FilePath              string            `json:"filepath"`
 		HeaderFilters         map[string]string `json:"header-filters"`
 		HeaderRegexFilters    map[string]string `json:"header-regex-filters"`
+		AddressFilters        map[string]string `json:"address-filters"`
+		DomainFilters         map[string]string `json:"domain-filters"`
+		TimeSource            string            `json:"time-source"`
 		FromTime              string            `json:"from-time"`
 		BeforeTime            string            `json:"before-time"`
 		AttachmentNames       []string          `json:"attachment-names"`
@@ -20,6 +29,13 @@ func TestReadWithFilters(t *testing.T) {
 		MessagesFound         uint              `json:"msg-found"`
 	}
 
+	timeSources := map[string]TimeSource{
+		"":                 TIME_SRC_ENVELOPE,
+		"envelope":         TIME_SRC_ENVELOPE,
+		"date":             TIME_SRC_DATE_HEADER,
+		"date-or-envelope": TIME_SRC_DATE_HEADER_OR_ENVELOPE,
+	}
+
 	testTable := make([]ReadWithFiltersTestCase, 1)
 	data, err := ioutil.ReadFile("testcases/reader_read_with_filters_cases.json")
 	if err != nil {
@@ -34,6 +50,8 @@ func TestReadWithFilters(t *testing.T) {
 				t.Errorf("Couldn't open the file %e", err)
 			}
 
+			mboxReader.SetTimeSource(timeSources[tcase.TimeSource])
+
 			fromTime, err := time.Parse(time.RFC1123, tcase.FromTime)
 			if err != nil {
 				t.Error(err)
@@ -50,20 +68,36 @@ func TestReadWithFilters(t *testing.T) {
 				mboxReader.WithHeader(hkey, headValue)
 			}
 			for hkey, headRgx := range tcase.HeaderRegexFilters {
-				mboxReader.WithHeaderRegex(hkey, headRgx)
+				_, err = mboxReader.WithHeaderRegex(hkey, headRgx)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			for hkey, address := range tcase.AddressFilters {
+				mboxReader.WithAddress(hkey, address)
+			}
+			for hkey, domain := range tcase.DomainFilters {
+				mboxReader.WithAddressDomain(hkey, domain)
 			}
 			for _, attName := range tcase.AttachmentNames {
 				mboxReader.WithAttachmentName(attName)
 			}
 			for _, attRgx := range tcase.AttachmentNameRegexes {
-				mboxReader.WithAttachmentNameRegex(attRgx)
+				_, err = mboxReader.WithAttachmentNameRegex(attRgx)
+				if err != nil {
+					t.Error(err)
+				}
 			}
 
 			var msgFound uint
 			msgFound = 0
 			for {
 				_, err := mboxReader.Read()
+				if err == io.EOF {
+					break
+				}
 				if err != nil {
+					t.Error(err)
 					break
 				}
 				msgFound += 1
@@ -75,3 +109,316 @@ func TestReadWithFilters(t *testing.T) {
 		})
 	}
 }
+
+func TestWithHeaderRegexInvalid(t *testing.T) {
+	mboxReader := NewMboxReaderFromReader(bytes.NewReader(nil))
+	_, err := mboxReader.WithHeaderRegex("Subject", `^\[JIRA-(\d+\]`)
+	if err == nil {
+		t.Error("An invalid pattern must be reported")
+	}
+}
+
+func TestReadFormats(t *testing.T) {
+	type ReadFormatsTestCase struct {
+		FilePath          string   `json:"filepath"`
+		Format            string   `json:"format"`
+		Subjects          []string `json:"subjects"`
+		BodyType          string   `json:"body-type"`
+		FirstBodyContains string   `json:"first-body-contains"`
+		Error             bool     `json:"error"`
+	}
+	formats := map[string]MboxFormat{
+		"auto":    MBOX_FMT_AUTO,
+		"mboxo":   MBOX_FMT_MBOXO,
+		"mboxcl":  MBOX_FMT_MBOXCL,
+		"mboxcl2": MBOX_FMT_MBOXCL2,
+		"mboxrd":  MBOX_FMT_MBOXRD,
+	}
+
+	testTable := make([]ReadFormatsTestCase, 8)
+	data, err := ioutil.ReadFile("testcases/reader_read_formats_cases.json")
+	if err != nil {
+		t.Errorf("Couldn't open a file with testcases %e", err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			mboxReader, err := NewMboxReader("testcases/distinct-messages/"+tcase.FilePath, 1, 0)
+			if err != nil {
+				t.Fatalf("Couldn't open the file %e", err)
+			}
+			mboxReader.SetFormat(formats[tcase.Format])
+
+			var subjects []string
+			var gotError bool
+			for {
+				msg, err := mboxReader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					gotError = true
+					break
+				}
+				if len(subjects) == 0 {
+					body, err := msg.Body(tcase.BodyType)
+					if err != nil {
+						t.Error(err)
+					}
+					if !strings.Contains(body, tcase.FirstBodyContains) {
+						t.Errorf("The first message body does not contain %q:\n%s\n", tcase.FirstBodyContains, body)
+					}
+				}
+				subject, _ := msg.Header(H_SUBJECT)
+				subjects = append(subjects, strings.Join(subject.Values, ""))
+			}
+
+			if gotError != tcase.Error {
+				t.Errorf("Error is wrong. Want:%t, got:%t\n", tcase.Error, gotError)
+			}
+			if fmt.Sprint(subjects) != fmt.Sprint(tcase.Subjects) {
+				t.Errorf("Subjects are wrong. Want:%v, got:%v\n", tcase.Subjects, subjects)
+			}
+		})
+	}
+}
+
+func TestReadParseModes(t *testing.T) {
+	type ReadParseModesTestCase struct {
+		FilePath    string     `json:"filepath"`
+		Mode        string     `json:"mode"`
+		Subjects    []string   `json:"subjects"`
+		Warnings    [][]string `json:"warnings"`
+		Attachments []int      `json:"attachments"`
+		Skipped     []int64    `json:"skipped"`
+		Error       bool       `json:"error"`
+	}
+	modes := map[string]ParseMode{
+		"strict":  PARSE_MODE_STRICT,
+		"lenient": PARSE_MODE_LENIENT,
+		"skip":    PARSE_MODE_SKIP,
+	}
+
+	testTable := make([]ReadParseModesTestCase, 4)
+	data, err := ioutil.ReadFile("testcases/reader_read_parse_modes_cases.json")
+	if err != nil {
+		t.Errorf("Couldn't open a file with testcases %e", err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			mboxReader, err := NewMboxReader("testcases/distinct-messages/"+tcase.FilePath, 1, 0)
+			if err != nil {
+				t.Fatalf("Couldn't open the file %e", err)
+			}
+			mboxReader.SetParseMode(modes[tcase.Mode])
+
+			subjects := make([]string, 0)
+			warnings := make([][]string, 0)
+			attachments := make([]int, 0)
+			var gotError bool
+			for {
+				msg, err := mboxReader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					gotError = true
+					break
+				}
+				subject, _ := msg.Header(H_SUBJECT)
+				subjects = append(subjects, strings.Join(subject.Values, ""))
+				msgWarnings := make([]string, 0)
+				for _, warning := range msg.Warnings() {
+					msgWarnings = append(msgWarnings, warning.Err.Error())
+				}
+				warnings = append(warnings, msgWarnings)
+				attachments = append(attachments, len(msg.Attachments()))
+			}
+			skipped := make([]int64, 0)
+			for _, message := range mboxReader.SkippedMessages() {
+				skipped = append(skipped, message.Offset)
+			}
+
+			if gotError != tcase.Error {
+				t.Errorf("Error is wrong. Want:%t, got:%t\n", tcase.Error, gotError)
+			}
+			if fmt.Sprint(subjects) != fmt.Sprint(tcase.Subjects) {
+				t.Errorf("Subjects are wrong. Want:%v, got:%v\n", tcase.Subjects, subjects)
+			}
+			if fmt.Sprintf("%q", warnings) != fmt.Sprintf("%q", tcase.Warnings) {
+				t.Errorf("Warnings are wrong. Want:%q, got:%q\n", tcase.Warnings, warnings)
+			}
+			if fmt.Sprint(attachments) != fmt.Sprint(tcase.Attachments) {
+				t.Errorf("Attachments are wrong. Want:%v, got:%v\n", tcase.Attachments, attachments)
+			}
+			if fmt.Sprint(skipped) != fmt.Sprint(tcase.Skipped) {
+				t.Errorf("Skipped messages are wrong. Want:%v, got:%v\n", tcase.Skipped, skipped)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	type ParseErrorsTestCase struct {
+		Index  int    `json:"index"`
+		Offset int64  `json:"offset"`
+		Line   int    `json:"line"`
+		Error  string `json:"error"`
+	}
+	sentinels := map[string]error{
+		"not-message-start":        ErrNotMessageStart,
+		"invalid-date":             ErrInvalidDate,
+		"empty-boundary":           ErrEmptyBoundary,
+		"closing-boundary-missing": ErrClosingBoundaryMissing,
+	}
+
+	testTable := make([]ParseErrorsTestCase, 5)
+	data, err := ioutil.ReadFile("testcases/reader_parse_errors_cases.json")
+	if err != nil {
+		t.Errorf("Couldn't open a file with testcases %e", err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	filePath := "testcases/distinct-messages/malformed.mbox"
+	mboxReader, err := NewMboxReader(filePath, 1, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open the file %e", err)
+	}
+	mboxReader.SetParseMode(PARSE_MODE_SKIP)
+	for {
+		_, err := mboxReader.Read()
+		if err != nil {
+			break
+		}
+	}
+	skipped := mboxReader.SkippedMessages()
+	if len(skipped) != len(testTable) {
+		t.Fatalf("Skipped messages count is wrong. Want:%d, got:%d\n", len(testTable), len(skipped))
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			var parseErr *ParseError
+			if !errors.As(skipped[ind].Err, &parseErr) {
+				t.Fatalf("Not a ParseError: %v\n", skipped[ind].Err)
+			}
+			if parseErr.Path != filePath || parseErr.Index != tcase.Index ||
+				parseErr.Offset != tcase.Offset || parseErr.Line != tcase.Line {
+				t.Errorf("Location is wrong. Want:%s %d %d %d, got:%s %d %d %d\n", filePath, tcase.Index,
+					tcase.Offset, tcase.Line, parseErr.Path, parseErr.Index, parseErr.Offset, parseErr.Line)
+			}
+			if !errors.Is(skipped[ind].Err, sentinels[tcase.Error]) {
+				t.Errorf("Error is wrong. Want:%v, got:%v\n", sentinels[tcase.Error], skipped[ind].Err)
+			}
+		})
+	}
+
+	strictReader, err := NewMboxReader(filePath, 1, 0)
+	if err != nil {
+		t.Fatalf("Couldn't open the file %e", err)
+	}
+	_, err = strictReader.Read()
+	if !errors.Is(err, ErrNotMessageStart) {
+		t.Errorf("Strict reading must fail on the leading garbage, got:%v\n", err)
+	}
+}
+
+func TestReadEmptyInput(t *testing.T) {
+	for _, input := range []string{"", "\n", "\n\r\n\n"} {
+		mboxReader := NewMboxReaderFromReader(strings.NewReader(input))
+		msg, err := mboxReader.Read()
+		if msg != nil || err != io.EOF {
+			t.Errorf("Reading %q. Want: nil, EOF, got: %v, %v\n", input, msg, err)
+		}
+	}
+}
+
+func TestReadFromReader(t *testing.T) {
+	files := []string{"message1.mbox", "message2.mbox", "reader-test-msg-1.mbox"}
+	var stream bytes.Buffer
+	var wantSenders []string
+	for _, file := range files {
+		mboxReader, err := NewMboxReader("testcases/distinct-messages/"+file, 1, 0)
+		if err != nil {
+			t.Fatalf("Couldn't open the file %e", err)
+		}
+		msg, err := mboxReader.Read()
+		if err != nil {
+			t.Fatalf("Couldn't read the file %s: %s", file, err)
+		}
+		wantSenders = append(wantSenders, msg.Sender())
+
+		data, err := ioutil.ReadFile("testcases/distinct-messages/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write(data)
+		stream.WriteString("\n\n")
+	}
+
+	mboxReader := NewMboxReaderFromReader(&stream)
+	var gotSenders []string
+	for {
+		msg, err := mboxReader.Read()
+		if err != nil {
+			break
+		}
+		gotSenders = append(gotSenders, msg.Sender())
+	}
+
+	if fmt.Sprint(gotSenders) != fmt.Sprint(wantSenders) {
+		t.Errorf("Senders are wrong. Want:%v, got:%v\n", wantSenders, gotSenders)
+	}
+}
+
+func TestReadStreamError(t *testing.T) {
+	errBroken := errors.New("connection reset")
+	contents := []string{
+		"From sender@example.com  Mon Mar  2 10:00:00 2020\nSubject: cut in headers\nTo: bob",
+		"From sender@example.com  Mon Mar  2 10:00:00 2020\nSubject: cut in body\n\nFirst line.\n",
+	}
+	for ind, content := range contents {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			stream := io.MultiReader(strings.NewReader(content), iotest.ErrReader(errBroken))
+			mboxReader := NewMboxReaderFromReader(stream)
+			msg, err := mboxReader.Read()
+			if !errors.Is(err, errBroken) {
+				t.Errorf("The read error must be returned, got message:%v, error:%v\n", msg != nil, err)
+			}
+		})
+	}
+}
+
+func TestSetFilePath(t *testing.T) {
+	mboxReader, err := NewMboxReader("testcases/distinct-messages/message1.mbox", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := mboxReader.file
+	_, err = mboxReader.SetFilePath("testcases/distinct-messages/mboxrd.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = previous.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("The previous file must be closed, got:%v\n", err)
+	}
+	msg, err := mboxReader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Sender() != "first@mail.com" {
+		t.Errorf("The new file must be read from the start, got:%s\n", msg.Sender())
+	}
+}
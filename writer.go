@@ -0,0 +1,230 @@
+package mbox_reader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MboxWriter appends messages to a mailbox file, locking it for every
+// message the same way MboxReader does.
+type MboxWriter struct {
+	file              *os.File
+	filepath          string
+	format            MboxFormat
+	lockStrategy      LockStrategy
+	lockTrialsCount   uint
+	lockTrialsTimeout uint
+}
+
+// MboxWriterIface is the writer API the package promises to keep stable.
+type MboxWriterIface interface {
+	Append(string, time.Time, io.Reader) error
+	AppendContext(context.Context, string, time.Time, io.Reader) error
+	SetFormat(MboxFormat) *MboxWriter
+	SetLockStrategy(LockStrategy) *MboxWriter
+	Close() error
+}
+
+var _ MboxWriterIface = (*MboxWriter)(nil)
+
+// NewMboxWriter opens the mailbox at filepath for appending, creating it
+// when it does not exist. Locking is retried as NewMboxReader describes.
+func NewMboxWriter(filepath string, lockTrialsCount uint, lockTrialsTimeout uint) (*MboxWriter, error) {
+	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &MboxWriter{
+		file:              file,
+		filepath:          filepath,
+		lockStrategy:      LOCK_FLOCK,
+		lockTrialsCount:   lockTrialsCount,
+		lockTrialsTimeout: lockTrialsTimeout,
+	}, nil
+}
+
+// Append adds a message to the end of the mailbox with a From_ line made of
+// sender and timestamp. message is the message as sent, headers and body,
+// with LF or CRLF line endings; it is held in memory while being written.
+// An empty sender is written as MAILER-DAEMON. From_ lines have no zone, so
+// timestamp is written in UTC, as readers take it.
+func (mboxWriter *MboxWriter) Append(sender string, timestamp time.Time, message io.Reader) error {
+	return mboxWriter.AppendContext(context.Background(), sender, timestamp, message)
+}
+
+// AppendContext is Append giving up waiting for the mailbox lock when ctx
+// is done.
+func (mboxWriter *MboxWriter) AppendContext(ctx context.Context, sender string, timestamp time.Time, message io.Reader) error {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	if strings.ContainsAny(sender, " \t\r\n") {
+		return ErrInvalidSender
+	}
+	content, err := io.ReadAll(message)
+	if err != nil {
+		return err
+	}
+
+	lock := newMboxLock(mboxWriter.lockStrategy, mboxWriter.file, mboxWriter.filepath)
+	_, err = acquireLock(ctx, lock, true, mboxWriter.lockTrialsCount, mboxWriter.lockTrialsTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	stat, err := mboxWriter.file.Stat()
+	if err != nil {
+		return err
+	}
+	var entry bytes.Buffer
+	entry.WriteString(mboxWriter.separator(stat.Size()))
+	entry.WriteString("From " + sender + " " + timestamp.UTC().Format(HEAD_TIMESTAMP_FMT) + "\n")
+	entry.Write(formatMessage(content, mboxWriter.format))
+	entry.WriteString("\n")
+
+	_, err = mboxWriter.file.WriteAt(entry.Bytes(), stat.Size())
+	if err == nil {
+		err = mboxWriter.file.Sync()
+	}
+	if err != nil {
+		// a partly written message would break the mailbox
+		mboxWriter.file.Truncate(stat.Size())
+		return err
+	}
+	return nil
+}
+
+// separator returns the line breaks needed for the mailbox of the given
+// size to end with a blank line before the next From_ line.
+func (mboxWriter *MboxWriter) separator(size int64) string {
+	if size == 0 {
+		return ""
+	}
+	tail := make([]byte, min(size, 3))
+	read, _ := mboxWriter.file.ReadAt(tail, size-int64(len(tail)))
+	tail = tail[:read]
+	switch {
+	case bytes.HasSuffix(tail, []byte("\n\n")) || bytes.HasSuffix(tail, []byte("\n\r\n")) ||
+		string(tail) == "\n" || string(tail) == "\r\n":
+		return ""
+	case bytes.HasSuffix(tail, []byte("\n")):
+		return "\n"
+	}
+	return "\n\n"
+}
+
+// formatMessage makes a message ready to be stored in the given format: body
+// lines looking like From_ lines are quoted, Content-Length is set for the
+// formats relying on it and the message ends with a line break.
+func formatMessage(content []byte, format MboxFormat) []byte {
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	headers, body := splitMessage(content)
+	if format != MBOX_FMT_MBOXCL2 {
+		body = quoteFromLines(body, format)
+	}
+	if format != MBOX_FMT_MBOXCL && format != MBOX_FMT_MBOXCL2 {
+		return append(headers, body...)
+	}
+
+	ending := "\n"
+	if bytes.HasSuffix(headers, []byte("\r\n\r\n")) {
+		ending = "\r\n"
+	}
+	var formatted bytes.Buffer
+	formatted.Write(removeHeader(bytes.TrimSuffix(headers, []byte(ending)), H_CT_LENGTH))
+	formatted.WriteString("Content-Length: " + strconv.Itoa(len(body)) + ending + ending)
+	formatted.Write(body)
+	return formatted.Bytes()
+}
+
+// splitMessage splits a message after the blank line ending its headers. A
+// message without a body gets the blank line added.
+func splitMessage(content []byte) (headers []byte, body []byte) {
+	if bytes.HasPrefix(content, []byte("\n")) {
+		return content[:1], content[1:]
+	}
+	if bytes.HasPrefix(content, []byte("\r\n")) {
+		return content[:2], content[2:]
+	}
+	end := -1
+	for _, separator := range []string{"\n\n", "\n\r\n"} {
+		if idx := bytes.Index(content, []byte(separator)); idx != -1 && (end == -1 || idx+len(separator) < end) {
+			end = idx + len(separator)
+		}
+	}
+	if end != -1 {
+		return content[:end], content[end:]
+	}
+	if bytes.HasSuffix(content, []byte("\r\n")) {
+		return append(content, "\r\n"...), nil
+	}
+	return append(content, '\n'), nil
+}
+
+// quoteFromLines quotes body lines as unquoteFromLine expects: mboxrd adds
+// a ">" to lines matching ^>*From , the other formats only to ^From .
+func quoteFromLines(body []byte, format MboxFormat) []byte {
+	var quoted bytes.Buffer
+	for len(body) > 0 {
+		line := body
+		if idx := bytes.IndexByte(body, '\n'); idx != -1 {
+			line = body[:idx+1]
+		}
+		body = body[len(line):]
+		unquoted := bytes.TrimLeft(line, ">")
+		if bytes.HasPrefix(unquoted, []byte("From ")) && (len(unquoted) == len(line) || format == MBOX_FMT_MBOXRD) {
+			quoted.WriteByte('>')
+		}
+		quoted.Write(line)
+	}
+	return quoted.Bytes()
+}
+
+// removeHeader drops every field with the given upper-cased name, folded
+// lines included, from a header block.
+func removeHeader(headers []byte, name string) []byte {
+	var kept bytes.Buffer
+	removing := false
+	for len(headers) > 0 {
+		line := headers
+		if idx := bytes.IndexByte(headers, '\n'); idx != -1 {
+			line = headers[:idx+1]
+		}
+		headers = headers[len(line):]
+		lineName, _, _ := splitHeaderLine(trimLineEnd(string(line)))
+		if lineName != "" || len(bytes.TrimSpace(line)) == 0 {
+			removing = lineName == name
+		}
+		if !removing {
+			kept.Write(line)
+		}
+	}
+	return kept.Bytes()
+}
+
+// SetFormat sets how messages are stored. MBOX_FMT_AUTO, the default, stores
+// them the way a reader in MBOX_FMT_AUTO reads them back, as MBOX_FMT_MBOXO.
+func (mboxWriter *MboxWriter) SetFormat(format MboxFormat) *MboxWriter {
+	mboxWriter.format = format
+	return mboxWriter
+}
+
+// SetLockStrategy sets how the mailbox file is locked while a message is
+// appended. It is LOCK_FLOCK by default.
+func (mboxWriter *MboxWriter) SetLockStrategy(strategy LockStrategy) *MboxWriter {
+	mboxWriter.lockStrategy = strategy
+	return mboxWriter
+}
+
+// Close closes the mailbox file.
+func (mboxWriter *MboxWriter) Close() error {
+	return mboxWriter.file.Close()
+}
@@ -0,0 +1,168 @@
+package mbox_reader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterAppend(t *testing.T) {
+	type AppendedMessage struct {
+		Sender  string `json:"sender"`
+		Content string `json:"content"`
+	}
+	type WriterAppendTestCase struct {
+		Format   string            `json:"format"`
+		Existing string            `json:"existing"`
+		Messages []AppendedMessage `json:"messages"`
+		Mailbox  string            `json:"mailbox"`
+		Bodies   []string          `json:"bodies"`
+	}
+	formats := map[string]MboxFormat{
+		"auto":    MBOX_FMT_AUTO,
+		"mboxo":   MBOX_FMT_MBOXO,
+		"mboxcl":  MBOX_FMT_MBOXCL,
+		"mboxcl2": MBOX_FMT_MBOXCL2,
+		"mboxrd":  MBOX_FMT_MBOXRD,
+	}
+	timestamp := time.Date(2020, time.March, 2, 10, 0, 0, 0, time.UTC)
+
+	testTable := make([]WriterAppendTestCase, 0)
+	data, err := ioutil.ReadFile("testcases/writer_append_cases.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ind, tcase := range testTable {
+		t.Run(fmt.Sprint(ind), func(t *testing.T) {
+			mboxPath := filepath.Join(t.TempDir(), "mbox")
+			if tcase.Existing != "" {
+				err := ioutil.WriteFile(mboxPath, []byte(tcase.Existing), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			mboxWriter, err := NewMboxWriter(mboxPath, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mboxWriter.SetFormat(formats[tcase.Format])
+			for _, message := range tcase.Messages {
+				err = mboxWriter.Append(message.Sender, timestamp, strings.NewReader(message.Content))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			mboxWriter.Close()
+
+			written, err := ioutil.ReadFile(mboxPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(written) != tcase.Mailbox {
+				t.Errorf("The mailbox is not correct.\nWant:\n%q\ngot:\n%q\n", tcase.Mailbox, written)
+			}
+
+			mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mboxReader.SetFormat(formats[tcase.Format])
+			var bodies []string
+			for {
+				msg, err := mboxReader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := msg.Body(CT_TXT_PLAIN)
+				if err != nil {
+					t.Error(err)
+				}
+				bodies = append(bodies, body)
+			}
+			if fmt.Sprintf("%q", bodies) != fmt.Sprintf("%q", tcase.Bodies) {
+				t.Errorf("Bodies read back are wrong. Want:%q, got:%q\n", tcase.Bodies, bodies)
+			}
+		})
+	}
+}
+
+func TestWriterTimestampZone(t *testing.T) {
+	mboxPath := filepath.Join(t.TempDir(), "mbox")
+	mboxWriter, err := NewMboxWriter(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2020, time.April, 8, 10, 22, 13, 0, time.FixedZone("MSK", 3*60*60))
+	err = mboxWriter.Append("sender@example.com", timestamp, strings.NewReader("Subject: x\n\nx\n"))
+	mboxWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mboxReader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Timestamp().Equal(timestamp) {
+		t.Errorf("Timestamp is not kept. Want:%s, got:%s\n", timestamp.UTC(), msg.Timestamp())
+	}
+}
+
+func TestWriterInvalidSender(t *testing.T) {
+	mboxWriter, err := NewMboxWriter(filepath.Join(t.TempDir(), "mbox"), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mboxWriter.Close()
+	err = mboxWriter.Append("two words", time.Now(), strings.NewReader("Subject: x\n\nx\n"))
+	if !errors.Is(err, ErrInvalidSender) {
+		t.Errorf("A sender with white space must be refused, got:%v\n", err)
+	}
+}
+
+func TestWriterLocking(t *testing.T) {
+	mboxPath := copyMailbox(t, "message1.mbox")
+	mboxReader, err := NewMboxReader(mboxPath, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mboxReader.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mboxWriter, err := NewMboxWriter(mboxPath, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mboxWriter.Close()
+	err = mboxWriter.Append("writer@example.com", time.Now(), strings.NewReader("Subject: x\n\nx\n"))
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Appending during a read session must wait for it, got:%v\n", err)
+	}
+
+	mboxReader.End()
+	err = mboxWriter.Append("writer@example.com", time.Now(), strings.NewReader("Subject: x\n\nx\n"))
+	if err != nil {
+		t.Errorf("Appending after the read session failed: %v\n", err)
+	}
+}